@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// authUsers maps basic auth usernames to passwords, populated from -auth-users
+var authUsers map[string]string
+
+// authRealm is sent in the WWW-Authenticate challenge
+var authRealm = "httpskeleton"
+
+// parseAuthUsers parses "user:password,user2:password2"
+func parseAuthUsers(s string) (map[string]string, error) {
+	users := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		user, pass, ok := strings.Cut(pair, ":")
+		if !ok || user == "" || pass == "" {
+			return nil, errors.New("expected user:password pairs")
+		}
+		users[user] = pass
+	}
+	return users, nil
+}
+
+// mwAuth requires HTTP Basic Auth credentials matching authUsers. The password is
+// never logged.
+func mwAuth(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || !checkPassword(user, pass) {
+			logEvent(r, "auth_failed", fmt.Sprintf("basic auth rejected for user %q", user))
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf("Basic realm=%q, charset=\"UTF-8\"", authRealm))
+			writeJSON(w, r, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+			return
+		}
+
+		logDataAdd(r, "user", user)
+		logEvent(r, "auth_succeeded", fmt.Sprintf("basic auth accepted for user %q", user))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// checkPassword compares in constant time. Unknown users are still compared
+// against a dummy value so response timing doesn't reveal which users exist.
+func checkPassword(user, pass string) bool {
+	want, known := authUsers[user]
+	if !known {
+		want = "\x00unknown user"
+	}
+	match := subtle.ConstantTimeCompare([]byte(pass), []byte(want)) == 1
+	return known && match
+}
+
+// parseAPIKeys parses "identity:key,identity2:key2" into a map from key to identity
+func parseAPIKeys(s string) (map[string]string, error) {
+	keys := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, key, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || key == "" {
+			return nil, errors.New("expected identity:key pairs")
+		}
+		if _, dup := keys[key]; dup {
+			return nil, fmt.Errorf("key for %q is already used by another identity", id)
+		}
+		keys[key] = id
+	}
+	return keys, nil
+}
+
+// mwAPIKey requires one of keys (key to identity, see parseAPIKeys) in the header
+// named header or, failing that, the query parameter param. An empty param turns
+// the query lookup off. The identity, never the key, is added to the log data.
+func mwAPIKey(keys map[string]string, header, param string) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sent := r.Header.Get(header)
+			if sent == "" && param != "" {
+				sent = r.URL.Query().Get(param)
+			}
+			if sent == "" {
+				logEvent(r, "auth_failed", "missing api key")
+				writeJSON(w, r, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+
+			id, ok := lookupAPIKey(keys, sent)
+			if !ok {
+				logEvent(r, "auth_failed", "invalid api key")
+				writeJSON(w, r, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+
+			logDataAdd(r, "api_key_id", id)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// sendsCredentials reports whether r authenticates itself explicitly, with an
+// Authorization header or an API key, rather than relying on cookies the browser
+// attaches on its own
+func sendsCredentials(r *http.Request, apiKeyHeader, apiKeyParam string) bool {
+	if r.Header.Get("Authorization") != "" {
+		return true
+	}
+	if apiKeyHeader != "" && r.Header.Get(apiKeyHeader) != "" {
+		return true
+	}
+	return apiKeyParam != "" && r.URL.Query().Has(apiKeyParam)
+}
+
+// lookupAPIKey compares sent against every key in constant time rather than
+// indexing the map, so timing doesn't reveal how close a guess was
+func lookupAPIKey(keys map[string]string, sent string) (string, bool) {
+	id, found := "", false
+	for key, identity := range keys {
+		if subtle.ConstantTimeCompare([]byte(sent), []byte(key)) == 1 {
+			id, found = identity, true
+		}
+	}
+	return id, found
+}
+
+// mwJWT requires a valid "Authorization: Bearer <token>" header. key is either an
+// HMAC secret ([]byte) or an *rsa.PublicKey, and decides which signing methods are
+// accepted. exp and nbf are checked when present. The claims are stored in the
+// request context (see jwtClaims) and the subject is added to the log data.
+func mwJWT(key interface{}) func(http.Handler) http.Handler {
+	var methods []string
+	switch key.(type) {
+	case []byte:
+		methods = []string{"HS256", "HS384", "HS512"}
+	case *rsa.PublicKey:
+		methods = []string{"RS256", "RS384", "RS512"}
+	default:
+		panic(fmt.Sprintf("mwJWT: unsupported key type %T", key))
+	}
+	parser := jwt.NewParser(jwt.WithValidMethods(methods))
+	keyFunc := func(*jwt.Token) (interface{}, error) { return key, nil }
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || raw == "" {
+				logEvent(r, "auth_failed", "missing bearer token")
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				writeJSON(w, r, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+
+			claims := jwt.MapClaims{}
+			if _, err := parser.ParseWithClaims(raw, claims, keyFunc); err != nil {
+				logEvent(r, "auth_failed", fmt.Sprintf("invalid bearer token: %v", err))
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				writeJSON(w, r, http.StatusUnauthorized, map[string]string{"error": "unauthorized"})
+				return
+			}
+
+			sub, _ := claims.GetSubject()
+			logDataAdd(r, "subject", sub)
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), claimsKey, claims)))
+		})
+	}
+}
+
+// jwtClaims returns the claims stored by mwJWT, or nil outside of it
+func jwtClaims(r *http.Request) jwt.MapClaims {
+	claims, _ := r.Context().Value(claimsKey).(jwt.MapClaims)
+	return claims
+}
+
+// loadRSAPublicKey reads a PEM encoded RSA public key for mwJWT
+func loadRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return jwt.ParseRSAPublicKeyFromPEM(b)
+}
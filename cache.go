@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheMaxEntries bounds how many paths mwCache keeps, evicting the least recently
+// used first. cacheMaxVariants bounds the responses kept per path for different
+// values of the Vary headers, and cacheMaxBody the size of any one of them.
+var (
+	cacheMaxEntries  = 1000
+	cacheMaxVariants = 16
+	cacheMaxBody     = 1 << 20
+)
+
+// mwCache serves repeated GETs from memory for up to ttl. Responses are keyed by
+// host, path, and query, then by the values of the request headers the
+// response's Vary names (see cacheEntry), and carry X-Cache: HIT or MISS, with
+// Age on hits. Only complete 200s are kept, and not those with Set-Cookie,
+// Cache-Control no-store or private, or Vary: *.
+//
+// Cached responses are shared between clients, so requests carrying credentials
+// (Authorization, a Cookie, or the API key in apiKeyHeader or apiKeyParam) are
+// never cached, and neither are protocol upgrades. A request with Cache-Control
+// no-store skips the cache entirely, no-cache only the lookup. It's meant as
+// per-route middleware, see route.cacheable, and stores the body before mwGzip
+// encodes it.
+func mwCache(ttl time.Duration, apiKeyHeader, apiKeyParam string) middleware {
+	c := newResponseCache(cacheMaxEntries)
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cc := r.Header.Get("Cache-Control")
+			if r.Method != http.MethodGet || hasCredentials(r, apiKeyHeader, apiKeyParam) ||
+				r.Header.Get("Upgrade") != "" || hasDirective(cc, "no-store") {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			// one server can answer for several hosts, with different content
+			key := strings.ToLower(r.Host) + r.URL.RequestURI()
+			if !hasDirective(cc, "no-cache") {
+				if resp := c.get(key, r); resp != nil {
+					age := time.Since(resp.stored)
+					if age < ttl {
+						logDataAdd(r, "cache", "hit")
+						for k, v := range resp.header {
+							w.Header()[k] = v
+						}
+						addVary(w.Header(), resp.vary)
+						w.Header().Set("Age", strconv.Itoa(int(age.Seconds())))
+						w.Header().Set("X-Cache", "HIT")
+						w.WriteHeader(resp.code)
+						w.Write(resp.body)
+						return
+					}
+				}
+			}
+
+			w.Header().Set("X-Cache", "MISS")
+			rec := &cacheRecorder{ResponseWriter: w, code: http.StatusOK}
+			h.ServeHTTP(rec, r)
+			if !rec.cacheable() {
+				return
+			}
+			header := w.Header().Clone()
+			vary := varyNames(header)
+			// a hit carries its own request ID and marker, and outer wrappers like
+			// mwGzip set the encoding and Vary of the bytes actually sent again
+			for _, k := range []string{"X-Request-ID", "X-Cache", "Content-Encoding", "Content-Length", "Vary"} {
+				header.Del(k)
+			}
+			c.put(key, r, &cachedResponse{
+				code:   rec.code,
+				header: header,
+				vary:   vary,
+				body:   rec.body.Bytes(),
+				stored: time.Now(),
+			})
+		})
+	}
+}
+
+// hasCredentials reports whether r carries anything that could make its response
+// specific to the client
+func hasCredentials(r *http.Request, apiKeyHeader, apiKeyParam string) bool {
+	return r.Header.Get("Cookie") != "" || sendsCredentials(r, apiKeyHeader, apiKeyParam)
+}
+
+// varyNames are the canonical header names listed in h's Vary headers
+func varyNames(h http.Header) []string {
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, textproto.CanonicalMIMEHeaderKey(name))
+			}
+		}
+	}
+	return names
+}
+
+// addVary adds the names to h's Vary that aren't in it yet
+func addVary(h http.Header, names []string) {
+	have := make(map[string]bool)
+	for _, name := range varyNames(h) {
+		have[name] = true
+	}
+	for _, name := range names {
+		if !have[name] {
+			have[name] = true
+			h.Add("Vary", name)
+		}
+	}
+}
+
+// hasDirective reports whether a Cache-Control header value includes directive
+func hasDirective(cacheControl, directive string) bool {
+	for _, d := range strings.Split(cacheControl, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if strings.EqualFold(name, directive) {
+			return true
+		}
+	}
+	return false
+}
+
+type cachedResponse struct {
+	code   int
+	header http.Header
+	vary   []string
+	body   []byte
+	stored time.Time
+}
+
+// cacheEntry is everything cached for one path: the header names its responses
+// vary on, and a response per combination of their values seen
+type cacheEntry struct {
+	key      string
+	vary     []string
+	variants map[string]*cachedResponse
+}
+
+// varyKey joins the values of the vary headers in r
+func (e *cacheEntry) varyKey(r *http.Request) string {
+	var b strings.Builder
+	for _, name := range e.vary {
+		b.WriteString(strings.Join(r.Header.Values(name), ","))
+		b.WriteByte(0)
+	}
+	return b.String()
+}
+
+// responseCache is an LRU of cacheEntries, safe for concurrent use
+type responseCache struct {
+	mu      sync.Mutex
+	max     int
+	order   *list.List // front is most recently used, of *cacheEntry
+	entries map[string]*list.Element
+}
+
+func newResponseCache(max int) *responseCache {
+	return &responseCache{max: max, order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *responseCache) get(key string, r *http.Request) *cachedResponse {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	c.order.MoveToFront(el)
+	e := el.Value.(*cacheEntry)
+	return e.variants[e.varyKey(r)]
+}
+
+func (c *responseCache) put(key string, r *http.Request, resp *cachedResponse) {
+	vary := resp.vary
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	var e *cacheEntry
+	if ok {
+		c.order.MoveToFront(el)
+		e = el.Value.(*cacheEntry)
+		// the handler changed what it varies on, so the old variants are keyed wrong
+		if strings.Join(e.vary, ",") != strings.Join(vary, ",") {
+			e.vary = vary
+			clear(e.variants)
+		}
+	} else {
+		e = &cacheEntry{key: key, vary: vary, variants: make(map[string]*cachedResponse)}
+		c.entries[key] = c.order.PushFront(e)
+		for c.order.Len() > c.max {
+			oldest := c.order.Back()
+			c.order.Remove(oldest)
+			delete(c.entries, oldest.Value.(*cacheEntry).key)
+		}
+	}
+	if len(e.variants) >= cacheMaxVariants {
+		clear(e.variants)
+	}
+	e.variants[e.varyKey(r)] = resp
+}
+
+// cacheRecorder copies the response on its way to the client, giving up on it
+// once it's too big, streamed, or hijacked
+type cacheRecorder struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+	skip        bool
+}
+
+func (c *cacheRecorder) WriteHeader(code int) {
+	if !c.wroteHeader {
+		c.wroteHeader = true
+		c.code = code
+	}
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *cacheRecorder) Write(b []byte) (int, error) {
+	c.wroteHeader = true
+	if !c.skip {
+		if c.body.Len()+len(b) > cacheMaxBody {
+			c.skip = true
+			c.body.Reset()
+		} else {
+			c.body.Write(b)
+		}
+	}
+	return c.ResponseWriter.Write(b)
+}
+
+// Flush means the handler is streaming, which isn't worth caching
+func (c *cacheRecorder) Flush() {
+	c.skip = true
+	c.body.Reset()
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *cacheRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	c.skip = true
+	return hj.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (c *cacheRecorder) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+func (c *cacheRecorder) cacheable() bool {
+	if c.skip || c.code != http.StatusOK {
+		return false
+	}
+	h := c.Header()
+	if h.Get("Set-Cookie") != "" {
+		return false
+	}
+	cc := strings.Join(h.Values("Cache-Control"), ",")
+	if hasDirective(cc, "no-store") || hasDirective(cc, "private") {
+		return false
+	}
+	for _, v := range h.Values("Vary") {
+		if strings.TrimSpace(v) == "*" {
+			return false
+		}
+	}
+	return true
+}
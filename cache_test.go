@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// countingHandler answers with how many times it has run
+func countingHandler(n *int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		*n++
+		fmt.Fprintf(w, "call %d", *n)
+	}
+}
+
+func TestMwCacheHitMiss(t *testing.T) {
+	var n int
+	h := mwCache(time.Minute, "X-API-Key", "api_key")(countingHandler(&n))
+
+	first := serve(h, httptest.NewRequest("GET", "/x?a=1", nil))
+	if got := first.Header().Get("X-Cache"); got != "MISS" {
+		t.Fatalf("first X-Cache = %q, want MISS", got)
+	}
+	second := serve(h, httptest.NewRequest("GET", "/x?a=1", nil))
+	if got := second.Header().Get("X-Cache"); got != "HIT" {
+		t.Fatalf("second X-Cache = %q, want HIT", got)
+	}
+	if second.Header().Get("Age") != "0" || second.Body.String() != "call 1" {
+		t.Errorf("hit: Age %q, body %q", second.Header().Get("Age"), second.Body.String())
+	}
+	if other := serve(h, httptest.NewRequest("GET", "/x?a=2", nil)); other.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("a different query was served from the cache")
+	}
+	if n != 2 {
+		t.Errorf("handler ran %d times, want 2", n)
+	}
+}
+
+func TestMwCacheExpiry(t *testing.T) {
+	var n int
+	h := mwCache(20*time.Millisecond, "", "")(countingHandler(&n))
+
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	time.Sleep(30 * time.Millisecond)
+	rec := serve(h, httptest.NewRequest("GET", "/", nil))
+	if rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "call 2" {
+		t.Errorf("after the ttl got %s %q, want a fresh MISS", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestMwCacheRequestDirectives(t *testing.T) {
+	var n int
+	h := mwCache(time.Minute, "", "")(countingHandler(&n))
+	serve(h, httptest.NewRequest("GET", "/", nil))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cache-Control", "no-store")
+	if rec := serve(h, req); rec.Header().Get("X-Cache") != "" || rec.Body.String() != "call 2" {
+		t.Errorf("no-store got %q %q, want the handler and no X-Cache", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Cache-Control", "no-cache")
+	if rec := serve(h, req); rec.Header().Get("X-Cache") != "MISS" {
+		t.Errorf("no-cache X-Cache = %q, want MISS", rec.Header().Get("X-Cache"))
+	}
+	if rec := serve(h, httptest.NewRequest("GET", "/", nil)); rec.Body.String() != "call 3" {
+		t.Errorf("no-cache didn't refresh the entry, got %q", rec.Body.String())
+	}
+}
+
+func TestMwCacheHost(t *testing.T) {
+	h := mwCache(time.Minute, "", "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host)
+	}))
+	get := func(host string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Host = host
+		return serve(h, req)
+	}
+
+	get("a.example")
+	if rec := get("b.example"); rec.Header().Get("X-Cache") != "MISS" || rec.Body.String() != "b.example" {
+		t.Errorf("another host got %s %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+	if rec := get("A.example"); rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != "a.example" {
+		t.Errorf("the same host in other case got %s %q", rec.Header().Get("X-Cache"), rec.Body.String())
+	}
+}
+
+func TestMwCacheVary(t *testing.T) {
+	h := mwCache(time.Minute, "", "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		io.WriteString(w, r.Header.Get("Accept-Language"))
+	}))
+	get := func(lang string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Language", lang)
+		return serve(h, req)
+	}
+
+	get("en")
+	get("fr")
+	for _, lang := range []string{"en", "fr"} {
+		rec := get(lang)
+		if rec.Header().Get("X-Cache") != "HIT" || rec.Body.String() != lang {
+			t.Errorf("%s: got %s %q", lang, rec.Header().Get("X-Cache"), rec.Body.String())
+		}
+		if rec.Header().Get("Vary") != "Accept-Language" {
+			t.Errorf("%s: hit lost its Vary, got %q", lang, rec.Header().Values("Vary"))
+		}
+	}
+}
+
+func TestMwCacheSkipsCredentials(t *testing.T) {
+	tests := []struct {
+		name string
+		url  string
+		set  func(*http.Request)
+	}{
+		{"authorization", "/", func(r *http.Request) { r.SetBasicAuth("bob", "pw") }},
+		{"cookie", "/", func(r *http.Request) { r.Header.Set("Cookie", "session=1") }},
+		{"api key header", "/", func(r *http.Request) { r.Header.Set("X-API-Key", "k1") }},
+		{"api key param", "/?api_key=k1", func(r *http.Request) {}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var n int
+			h := mwCache(time.Minute, "X-API-Key", "api_key")(countingHandler(&n))
+			for i := 0; i < 2; i++ {
+				req := httptest.NewRequest("GET", tt.url, nil)
+				tt.set(req)
+				if rec := serve(h, req); rec.Header().Get("X-Cache") != "" {
+					t.Errorf("credentialed request got X-Cache %q", rec.Header().Get("X-Cache"))
+				}
+			}
+			// nothing the credentialed requests got may reach an anonymous one
+			rec := serve(h, httptest.NewRequest("GET", "/", nil))
+			if rec.Header().Get("X-Cache") != "MISS" || n != 3 {
+				t.Errorf("anonymous request got %s after %d calls, want a MISS on call 3", rec.Header().Get("X-Cache"), n)
+			}
+		})
+	}
+}
+
+func TestMwCacheUncacheableResponses(t *testing.T) {
+	tests := map[string]http.HandlerFunc{
+		"not 200":    func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusAccepted) },
+		"set-cookie": func(w http.ResponseWriter, r *http.Request) { w.Header().Set("Set-Cookie", "a=b") },
+		"private":    func(w http.ResponseWriter, r *http.Request) { w.Header().Set("Cache-Control", "private") },
+		"vary star":  func(w http.ResponseWriter, r *http.Request) { w.Header().Set("Vary", "*") },
+	}
+	for name, handler := range tests {
+		t.Run(name, func(t *testing.T) {
+			h := mwCache(time.Minute, "", "")(handler)
+			serve(h, httptest.NewRequest("GET", "/", nil))
+			if rec := serve(h, httptest.NewRequest("GET", "/", nil)); rec.Header().Get("X-Cache") != "MISS" {
+				t.Errorf("X-Cache = %q, want the response not stored", rec.Header().Get("X-Cache"))
+			}
+		})
+	}
+}
+
+func TestMwCacheBehindGzip(t *testing.T) {
+	body := strings.Repeat("cache me ", 500)
+	h := mwGzip(mwCache(time.Minute, "", "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	})))
+	get := func(encoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", encoding)
+		return serve(h, req)
+	}
+
+	get("gzip")
+	hit := get("gzip")
+	if hit.Header().Get("X-Cache") != "HIT" || hit.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got X-Cache %q, Content-Encoding %q", hit.Header().Get("X-Cache"), hit.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(hit.Body)
+	if err != nil {
+		t.Fatalf("hit isn't gzip: %v", err)
+	}
+	if b, _ := io.ReadAll(zr); string(b) != body {
+		t.Errorf("hit body doesn't round-trip")
+	}
+	if got := hit.Header().Values("Vary"); len(got) != 1 || got[0] != "Accept-Encoding" {
+		t.Errorf("Vary = %q, want Accept-Encoding once", got)
+	}
+
+	// Accept-Encoding is in the Vary, so plain clients get their own entry
+	get("identity")
+	plain := get("identity")
+	if plain.Header().Get("X-Cache") != "HIT" || plain.Header().Get("Content-Encoding") != "" || plain.Body.String() != body {
+		t.Errorf("plain hit: X-Cache %q, Content-Encoding %q", plain.Header().Get("X-Cache"), plain.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestMwCacheHijack(t *testing.T) {
+	h := mwCache(time.Minute, "", "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hj, ok := w.(http.Hijacker)
+		if !ok {
+			http.Error(w, "no hijacker", http.StatusInternalServerError)
+			return
+		}
+		conn, rw, err := hj.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+	}))
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for _, upgrade := range []string{"", "test"} {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: x\r\nConnection: Upgrade\r\nUpgrade: %s\r\n\r\n", upgrade)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Errorf("Upgrade %q: got %d, want 101", upgrade, resp.StatusCode)
+		}
+	}
+}
+
+func TestResponseCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newResponseCache(2)
+	req := httptest.NewRequest("GET", "/", nil)
+	c.put("a", req, &cachedResponse{header: http.Header{}})
+	c.put("b", req, &cachedResponse{header: http.Header{}})
+	c.get("a", req)
+	c.put("c", req, &cachedResponse{header: http.Header{}})
+
+	if c.get("b", req) != nil {
+		t.Error("b should have been evicted as least recently used")
+	}
+	if c.get("a", req) == nil || c.get("c", req) == nil {
+		t.Error("a and c should still be cached")
+	}
+}
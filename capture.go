@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+)
+
+// mwCapture logs up to limit bytes of the request and response bodies as
+// request_body and response_body, redacted with redactBody. It's for
+// troubleshooting only (-debug-capture): bodies routinely hold personal data, and
+// buffering them costs memory on every request. The request body is teed, so
+// handlers still read all of it; only what they read is captured.
+func mwCapture(limit int) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			reqBody := &captureBuffer{limit: limit}
+			if r.Body != nil && r.Body != http.NoBody {
+				r.Body = struct {
+					io.Reader
+					io.Closer
+				}{io.TeeReader(r.Body, reqBody), r.Body}
+			}
+			cw := &captureWriter{ResponseWriter: w, body: captureBuffer{limit: limit}}
+
+			h.ServeHTTP(cw, r)
+
+			if reqBody.Len() > 0 {
+				logDataAdd(r, "request_body", redactBody(r.Header.Get("Content-Type"), reqBody.Bytes(), reqBody.truncated))
+			}
+			if cw.body.Len() > 0 {
+				logDataAdd(r, "response_body", redactBody(w.Header().Get("Content-Type"), cw.body.Bytes(), cw.body.truncated))
+			}
+		})
+	}
+}
+
+// captureBuffer keeps the first limit bytes written to it and drops the rest,
+// never failing a write
+type captureBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (c *captureBuffer) Write(p []byte) (int, error) {
+	if room := c.limit - c.Len(); len(p) > room {
+		c.truncated = true
+		c.Buffer.Write(p[:max(room, 0)])
+	} else {
+		c.Buffer.Write(p)
+	}
+	return len(p), nil
+}
+
+// captureWriter copies the response body into body on its way out
+type captureWriter struct {
+	http.ResponseWriter
+	body captureBuffer
+}
+
+func (c *captureWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.body.Write(p[:n])
+	return n, err
+}
+
+func (c *captureWriter) Flush() {
+	if f, ok := c.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (c *captureWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := c.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	return hj.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the writers underneath
+func (c *captureWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
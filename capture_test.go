@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMwCaptureTeesBody(t *testing.T) {
+	logs := captureLogs(t)
+	body := `{"user":"bob","password":"hunter2","padding":"` + strings.Repeat("x", 100) + `"}`
+	var read string
+	h := mwLog(mwCapture(32)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Errorf("reading the body: %v", err)
+		}
+		read = string(b)
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, `{"token":"t1","ok":true}`)
+	})))
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	rec := serve(h, req)
+	if read != body {
+		t.Errorf("handler read %d of %d body bytes", len(read), len(body))
+	}
+	if rec.Body.String() != `{"token":"t1","ok":true}` {
+		t.Errorf("response body changed to %q", rec.Body.String())
+	}
+
+	line := logs.event(t, "request")
+	if got := line["request_body"]; got != redacted {
+		t.Errorf("a truncated JSON body logged as %v, want it redacted whole", got)
+	}
+	if got, _ := line["response_body"].(string); strings.Contains(got, "t1") || !strings.Contains(got, `"ok":true`) {
+		t.Errorf("response_body = %q, want the token redacted and the rest kept", got)
+	}
+}
+
+func TestCaptureBufferLimit(t *testing.T) {
+	c := &captureBuffer{limit: 4}
+	if n, err := c.Write([]byte("abc")); n != 3 || err != nil {
+		t.Fatal(n, err)
+	}
+	if n, err := c.Write([]byte("defg")); n != 4 || err != nil {
+		t.Errorf("an overflowing write returned %d, %v; it must never fail", n, err)
+	}
+	c.Write([]byte("h"))
+	if c.String() != "abcd" || !c.truncated {
+		t.Errorf("kept %q, truncated %v", c.String(), c.truncated)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// mwCleanPath redirects /foo/ to /foo, keeping the query string. GET and HEAD get
+// a 301; anything else gets a 308 so the method and body survive the redirect.
+// Paths under a skip prefix are left alone, since http.FileServer redirects
+// directories the other way and the two would loop.
+func mwCleanPath(skip ...string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/" || !strings.HasSuffix(r.URL.Path, "/") {
+				next.ServeHTTP(w, r)
+				return
+			}
+			for _, prefix := range skip {
+				if prefix != "" && strings.HasPrefix(r.URL.Path, prefix) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			// collapse leading slashes too, or //evil.example/ would redirect off-site
+			u := *r.URL
+			u.Path = "/" + strings.Trim(u.Path, "/")
+			u.RawPath = ""
+			code := http.StatusPermanentRedirect
+			if r.Method == http.MethodGet || r.Method == http.MethodHead {
+				code = http.StatusMovedPermanently
+			}
+			http.Redirect(w, r, u.RequestURI(), code)
+		})
+	}
+}
+
+// mwNormalizePath collapses duplicate slashes and resolves . and .. segments, so
+// /private//auth, //private/auth, and /x/../private/auth all reach the route, and
+// its mwAuth, meant for /private/auth. With redirect the client is sent to the
+// clean path the way mwCleanPath does it; otherwise the request is routed as if
+// it had asked for it.
+// The query string is kept, and an encoded slash (%2F) stays part of its segment.
+// A trailing slash is kept too, that's mwCleanPath's job.
+func mwNormalizePath(redirect bool) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			escaped := r.URL.EscapedPath()
+			clean := normalizePath(escaped)
+			if clean == escaped {
+				next.ServeHTTP(w, r)
+				return
+			}
+			path, err := url.PathUnescape(clean)
+			if err != nil {
+				// EscapedPath only returns what parses, so this can't happen
+				next.ServeHTTP(w, r)
+				return
+			}
+			logEvent(r, "path_normalized", fmt.Sprintf("%q to %q", escaped, clean))
+
+			u := *r.URL
+			u.Path = path
+			u.RawPath = ""
+			if path != clean {
+				u.RawPath = clean
+			}
+			if redirect {
+				code := http.StatusPermanentRedirect
+				if r.Method == http.MethodGet || r.Method == http.MethodHead {
+					code = http.StatusMovedPermanently
+				}
+				http.Redirect(w, r, u.RequestURI(), code)
+				return
+			}
+			// a shallow copy, so outer middleware still see the original path
+			r = r.WithContext(r.Context())
+			r.URL = &u
+			r.RequestURI = u.RequestURI()
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// normalizePath cleans an escaped path segment by segment. Dot segments are
+// matched after unescaping, so %2e%2e counts as .. too.
+func normalizePath(escaped string) string {
+	var segs []string
+	for _, seg := range strings.Split(escaped, "/") {
+		dec, err := url.PathUnescape(seg)
+		if err != nil {
+			dec = seg
+		}
+		switch dec {
+		case "", ".":
+		case "..":
+			if len(segs) > 0 {
+				segs = segs[:len(segs)-1]
+			}
+		default:
+			segs = append(segs, seg)
+		}
+	}
+	clean := "/" + strings.Join(segs, "/")
+	last := escaped[strings.LastIndex(escaped, "/")+1:]
+	if clean != "/" && (last == "" || last == "." || last == "..") {
+		clean += "/"
+	}
+	return clean
+}
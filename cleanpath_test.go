@@ -0,0 +1,118 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizePath(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"/", "/"},
+		{"/private/auth", "/private/auth"},
+		{"/private//auth", "/private/auth"},
+		{"//private/auth", "/private/auth"},
+		{"///private///auth", "/private/auth"},
+		{"/x/../private/auth", "/private/auth"},
+		{"/./private/./auth", "/private/auth"},
+		{"/../../../etc/passwd", "/etc/passwd"},
+		{"/a/b/..", "/a/"},
+		{"/a/b/.", "/a/b/"},
+		{"/a//", "/a/"},
+		{"/..", "/"},
+		{"/a/%2e%2e/b", "/b"},
+		{"/a/%2E/b", "/a/b"},
+		{"/a%2Fb/c", "/a%2Fb/c"},
+		{"/a%2F..%2Fb", "/a%2F..%2Fb"},
+		{"/x/%2e%2e%2fb", "/x/%2e%2e%2fb"},
+		{"/a/...", "/a/..."},
+	}
+	for _, tt := range tests {
+		if got := normalizePath(tt.in); got != tt.want {
+			t.Errorf("normalizePath(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestMwNormalizePathRoutes(t *testing.T) {
+	tests := []struct {
+		target, path, escaped, query string
+	}{
+		{"//private/auth?x=1", "/private/auth", "/private/auth", "x=1"},
+		{"/x/../private/auth?q=a%2Fb&q=..", "/private/auth", "/private/auth", "q=a%2Fb&q=.."},
+		{"/files/a%2Fb//c", "/files/a/b/c", "/files/a%2Fb/c", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			logs := captureLogs(t)
+			var got *http.Request
+			h := mwNormalizePath(false)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = r }))
+
+			serve(h, httptest.NewRequest("GET", tt.target, nil))
+			if got.URL.Path != tt.path || got.URL.EscapedPath() != tt.escaped || got.URL.RawQuery != tt.query {
+				t.Errorf("routed as %q (%q) ? %q, want %q (%q) ? %q", got.URL.Path, got.URL.EscapedPath(), got.URL.RawQuery, tt.path, tt.escaped, tt.query)
+			}
+			if got.RequestURI != got.URL.RequestURI() {
+				t.Errorf("RequestURI %q doesn't match the cleaned URL", got.RequestURI)
+			}
+			logs.event(t, "path_normalized")
+		})
+	}
+}
+
+func TestMwNormalizePathRedirect(t *testing.T) {
+	captureLogs(t)
+	h := mwNormalizePath(true)(http.HandlerFunc(anotherHandler))
+	tests := []struct {
+		method string
+		code   int
+	}{
+		{"GET", http.StatusMovedPermanently},
+		{"POST", http.StatusPermanentRedirect},
+	}
+	for _, tt := range tests {
+		rec := serve(h, httptest.NewRequest(tt.method, "/a//b/../c?x=%2F", nil))
+		if rec.Code != tt.code || rec.Header().Get("Location") != "/a/c?x=%2F" {
+			t.Errorf("%s got %d to %q", tt.method, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func TestMwNormalizePathLeavesCleanPaths(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwNormalizePath(true)(http.HandlerFunc(anotherHandler))
+	for _, target := range []string{"/", "/private/auth", "/a%2Fb", "/a/"} {
+		if rec := serve(h, httptest.NewRequest("GET", target, nil)); rec.Code != http.StatusOK {
+			t.Errorf("%s got %d, want it passed through", target, rec.Code)
+		}
+	}
+	if n := len(logs.events("path_normalized")); n != 0 {
+		t.Errorf("clean paths logged %d path_normalized events", n)
+	}
+}
+
+func TestMwCleanPath(t *testing.T) {
+	h := mwCleanPath("/static/")(http.HandlerFunc(anotherHandler))
+	tests := []struct {
+		method, target string
+		code           int
+		location       string
+	}{
+		{"GET", "/private/auth/", http.StatusMovedPermanently, "/private/auth"},
+		{"HEAD", "/private/auth/", http.StatusMovedPermanently, "/private/auth"},
+		{"GET", "/private/auth/?a=1&b=%2F", http.StatusMovedPermanently, "/private/auth?a=1&b=%2F"},
+		{"POST", "/things/", http.StatusPermanentRedirect, "/things"},
+		{"GET", "//evil.example/", http.StatusMovedPermanently, "/evil.example"},
+		{"GET", "/private/auth", http.StatusOK, ""},
+		{"GET", "/", http.StatusOK, ""},
+		{"GET", "/static/css/", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			rec := serve(h, httptest.NewRequest(tt.method, tt.target, nil))
+			if rec.Code != tt.code || rec.Header().Get("Location") != tt.location {
+				t.Errorf("got %d to %q, want %d to %q", rec.Code, rec.Header().Get("Location"), tt.code, tt.location)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+)
+
+// gzipMinSize is the smallest response body worth compressing. Smaller bodies are
+// sent as is since the framing would outweigh any savings.
+var gzipMinSize = 1024
+
+// compressor is what gzip.Writer and brotli.Writer have in common
+type compressor interface {
+	io.Writer
+	Reset(w io.Writer)
+	Flush() error
+	Close() error
+}
+
+// compressors pools a writer per Content-Encoding mwGzip can produce
+var compressors = map[string]*sync.Pool{
+	"br": {New: func() interface{} {
+		return brotli.NewWriterLevel(io.Discard, brotli.DefaultCompression)
+	}},
+	"gzip": {New: func() interface{} {
+		return gzip.NewWriter(io.Discard)
+	}},
+}
+
+// encodingPreference is the order Content-Encodings are picked in when the client
+// rates them equally
+var encodingPreference = []string{"br", "gzip"}
+
+// mwGzip compresses responses with brotli or gzip, whichever the client prefers,
+// see negotiateEncoding. It belongs inside mwLog so the logged status is the one
+// the handler chose.
+func mwGzip(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r)
+		if r.Method == http.MethodHead || encoding == "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// not deferred: on a panic whatever is held back is dropped so mwPanic,
+		// further out, can still send its 500
+		gw := &gzipWriter{ResponseWriter: w, code: http.StatusOK, encoding: encoding}
+		h.ServeHTTP(gw, r)
+		gw.Close()
+	})
+}
+
+// negotiateEncoding picks the Content-Encoding from encodingPreference with the
+// highest quality in Accept-Encoding, breaking ties by that order. It returns ""
+// when none is acceptable or identity is rated higher than all of them.
+func negotiateEncoding(r *http.Request) string {
+	best, bestQ := "", 0.0
+	for _, coding := range encodingPreference {
+		if q := encodingQuality(r, coding); q > bestQ {
+			best, bestQ = coding, q
+		}
+	}
+	if best != "" && encodingQuality(r, "identity") > bestQ {
+		return ""
+	}
+	return best
+}
+
+// encodingQuality is coding's quality in the Accept-Encoding header, falling back
+// to that of *. Identity is 1 unless it's rated explicitly.
+func encodingQuality(r *http.Request, coding string) float64 {
+	star := -1.0
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.TrimSpace(name)
+		if strings.EqualFold(name, coding) {
+			return qValue(params)
+		}
+		if name == "*" {
+			star = qValue(params)
+		}
+	}
+	if star >= 0 {
+		return star
+	}
+	if coding == "identity" {
+		return 1
+	}
+	return 0
+}
+
+// qValue parses the quality out of the parameters of an Accept style header
+// element, e.g. "q=0.5" from "text/plain;q=0.5". A missing or malformed q is 1.
+func qValue(params string) float64 {
+	for _, p := range strings.Split(params, ";") {
+		k, v, _ := strings.Cut(strings.TrimSpace(p), "=")
+		if strings.TrimSpace(k) != "q" {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return 1
+		}
+		return q
+	}
+	return 1
+}
+
+// gzipWriter holds back the status and the first gzipMinSize bytes of the body
+// until it knows whether the response is big enough to compress
+type gzipWriter struct {
+	http.ResponseWriter
+	encoding    string
+	gz          compressor
+	buf         []byte
+	code        int
+	wroteHeader bool
+	started     bool
+	hijacked    bool
+}
+
+func (g *gzipWriter) WriteHeader(code int) {
+	if g.wroteHeader || g.started {
+		return
+	}
+	g.wroteHeader = true
+	g.code = code
+}
+
+func (g *gzipWriter) Write(b []byte) (int, error) {
+	if g.started {
+		if g.gz != nil {
+			return g.gz.Write(b)
+		}
+		return g.ResponseWriter.Write(b)
+	}
+
+	g.buf = append(g.buf, b...)
+	if len(g.buf) >= gzipMinSize {
+		if err := g.start(true); err != nil {
+			return 0, err
+		}
+	}
+	return len(b), nil
+}
+
+// start commits to compressing or not, then sends the status and anything buffered
+func (g *gzipWriter) start(compress bool) error {
+	g.started = true
+
+	hdr := g.Header()
+	if hdr.Get("Content-Encoding") != "" || g.code < 200 || g.code == http.StatusNoContent || g.code == http.StatusNotModified {
+		compress = false
+	}
+	if compress {
+		// sniff the type from the plain body, not the compressed one
+		if hdr.Get("Content-Type") == "" {
+			hdr.Set("Content-Type", http.DetectContentType(g.buf))
+		}
+		hdr.Set("Content-Encoding", g.encoding)
+		hdr.Del("Content-Length")
+		g.gz = compressors[g.encoding].Get().(compressor)
+		g.gz.Reset(g.ResponseWriter)
+	}
+	g.ResponseWriter.WriteHeader(g.code)
+
+	buf := g.buf
+	g.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if g.gz != nil {
+		_, err = g.gz.Write(buf)
+	} else {
+		_, err = g.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+// Close sends any response still held back and finishes the compressed stream
+func (g *gzipWriter) Close() error {
+	if g.hijacked {
+		return nil
+	}
+	if !g.started {
+		if err := g.start(false); err != nil {
+			return err
+		}
+	}
+	if g.gz == nil {
+		return nil
+	}
+	err := g.gz.Close()
+	compressors[g.encoding].Put(g.gz)
+	g.gz = nil
+	return err
+}
+
+// Flush commits to compressing so streamed output isn't held back
+func (g *gzipWriter) Flush() {
+	if !g.started {
+		g.start(true)
+	}
+	if g.gz != nil {
+		g.gz.Flush()
+	}
+	if f, ok := g.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (g *gzipWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := g.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	g.hijacked = true
+	return hj.Hijack()
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func gzipGet(h http.Handler) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	return serve(h, req)
+}
+
+func TestMwGzipRoundTrip(t *testing.T) {
+	body := strings.Repeat(`{"hello":"world"}`, 200)
+	rec := gzipGet(mwGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for i := 0; i < len(body); i += 100 {
+			io.WriteString(w, body[i:min(i+100, len(body))])
+		}
+	})))
+
+	if rec.Header().Get("Content-Encoding") != "gzip" || rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Fatalf("Content-Encoding %q, Vary %q", rec.Header().Get("Content-Encoding"), rec.Header().Get("Vary"))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := io.ReadAll(zr); err != nil || string(b) != body {
+		t.Errorf("body doesn't round-trip: %v", err)
+	}
+	if rec.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Content-Type = %q", rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestMwGzipSkips(t *testing.T) {
+	big := strings.Repeat("a", gzipMinSize*2)
+	tests := []struct {
+		name    string
+		accept  string
+		handler http.HandlerFunc
+	}{
+		{"below the minimum", "gzip", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "tiny") }},
+		{"not accepted", "", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, big) }},
+		{"already encoded", "gzip", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "identity")
+			io.WriteString(w, big)
+		}},
+		{"no content", "gzip", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept-Encoding", tt.accept)
+			}
+			rec := serve(mwGzip(tt.handler), req)
+			if rec.Header().Get("Content-Encoding") == "gzip" {
+				t.Error("response was compressed")
+			}
+			want := httptest.NewRecorder()
+			tt.handler(want, req)
+			if rec.Code != want.Code || rec.Body.String() != want.Body.String() {
+				t.Errorf("got %d %q, want the handler's %d %q", rec.Code, rec.Body.String(), want.Code, want.Body.String())
+			}
+		})
+	}
+}
+
+func TestMwGzipKeepsStatus(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwLog(mwGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, strings.Repeat("a", gzipMinSize*2))
+	})))
+
+	rec := gzipGet(h)
+	if rec.Code != http.StatusCreated || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("got %d, Content-Encoding %q", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+	if got := logs.event(t, "request")["code"]; got != http.StatusCreated {
+		t.Errorf("logged code %v, want 201", got)
+	}
+}
+
+func TestMwGzipFlush(t *testing.T) {
+	rec := gzipGet(mwGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "event: 1\n\n")
+		w.(http.Flusher).Flush()
+	})))
+	if !rec.Flushed || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Flushed %v, Content-Encoding %q; want a short streamed body compressed and flushed", rec.Flushed, rec.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(zr); string(b) != "event: 1\n\n" {
+		t.Errorf("body = %q", b)
+	}
+}
+
+func TestMwGzipHijack(t *testing.T) {
+	srv := httptest.NewServer(mwGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			t.Errorf("Hijack: %v", err)
+			return
+		}
+		defer conn.Close()
+		rw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 2\r\nConnection: close\r\n\r\nhi")
+		rw.Flush()
+	})))
+	defer srv.Close()
+
+	req, _ := http.NewRequest("GET", srv.URL, nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if b, _ := io.ReadAll(resp.Body); string(b) != "hi" {
+		t.Errorf("hijacked response got %q", b)
+	}
+}
+
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept, want string
+	}{
+		{"br, gzip", "br"},
+		{"gzip, br", "br"},
+		{"gzip", "gzip"},
+		{"br;q=0.5, gzip", "gzip"},
+		{"gzip, br;q=1", "br"},
+		{"*", "br"},
+		{"*;q=0, gzip", "gzip"},
+		{"br;q=0, gzip;q=0", ""},
+		{"gzip;q=0.5, identity", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", tt.accept)
+		if got := negotiateEncoding(req); got != tt.want {
+			t.Errorf("Accept-Encoding %q: got %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestMwGzipBrotli(t *testing.T) {
+	body := strings.Repeat(`{"hello":"world"}`, 200)
+	h := mwGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "br, gzip")
+	rec := serve(h, req)
+
+	if rec.Header().Get("Content-Encoding") != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", rec.Header().Get("Content-Encoding"))
+	}
+	if b, err := io.ReadAll(brotli.NewReader(rec.Body)); err != nil || string(b) != body {
+		t.Errorf("body doesn't round-trip: %v", err)
+	}
+
+	// the size threshold applies to brotli too
+	small := mwGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "tiny")
+	}))
+	if rec := serve(small, req); rec.Header().Get("Content-Encoding") != "" || rec.Body.String() != "tiny" {
+		t.Errorf("small response got Content-Encoding %q", rec.Header().Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/facebookgo/flagenv"
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every setting of the server. Each field is bound to the flag named in
+// its json tag, so the same names work on the command line, in the environment via
+// flagenv, and in a -config file.
+type Config struct {
+	Port              int           `json:"port"`
+	Addr              string        `json:"addr"`
+	UnixSocket        string        `json:"unix-socket"`
+	HTTPAddr          string        `json:"http-addr"`
+	HTTPSRedirect     bool          `json:"https-redirect"`
+	HTTPSHost         string        `json:"https-host"`
+	RequireHTTPS      string        `json:"require-https"`
+	TLSCert           string        `json:"tls-cert"`
+	TLSKey            string        `json:"tls-key"`
+	ClientCA          string        `json:"client-ca"`
+	ACMEDomains       string        `json:"acme-domains"`
+	ACMECacheDir      string        `json:"acme-cache-dir"`
+	ShutdownTimeout   time.Duration `json:"shutdown-timeout"`
+	ShutdownDelay     time.Duration `json:"shutdown-delay"`
+	HandlerTimeout    time.Duration `json:"handler-timeout"`
+	ReadTimeout       time.Duration `json:"read-timeout"`
+	ReadHeaderTimeout time.Duration `json:"read-header-timeout"`
+	WriteTimeout      time.Duration `json:"write-timeout"`
+	IdleTimeout       time.Duration `json:"idle-timeout"`
+	DisableKeepAlive  bool          `json:"disable-keepalive"`
+	MaxBodyBytes      int64         `json:"max-body-bytes"`
+	MaxHeaderBytes    int           `json:"max-header-bytes"`
+	MaxInflight       int           `json:"max-inflight"`
+	ContentTypes      string        `json:"content-types"`
+	RateLimit         float64       `json:"rate-limit"`
+	RateBurst         int           `json:"rate-burst"`
+	DebugAddr         string        `json:"debug-addr"`
+	DebugCapture      int           `json:"debug-capture"`
+
+	HealthPath   string `json:"health-path"`
+	ReadyPath    string `json:"ready-path"`
+	StatusPath   string `json:"status-path"`
+	MetricsPath  string `json:"metrics-path"`
+	StaticDir    string `json:"static-dir"`
+	StaticPrefix string `json:"static-prefix"`
+
+	LogLevel        string        `json:"log-level"`
+	LogFormat       string        `json:"log-format"`
+	LogOutput       string        `json:"log-output"`
+	AccessLogOutput string        `json:"access-log-output"`
+	AccessLogFormat string        `json:"access-log-format"`
+	AccessLogLevel  string        `json:"access-log-level"`
+	LogFields       string        `json:"log-fields"`
+	LogAsync        bool          `json:"log-async"`
+	LogAsyncBuffer  int           `json:"log-async-buffer"`
+	LogAsyncBlock   bool          `json:"log-async-block"`
+	LogHeaders      bool          `json:"log-headers"`
+	LogTTS          bool          `json:"log-tts"`
+	LogTime         string        `json:"log-time"`
+	LogSampleRate   int           `json:"log-sample-rate"`
+	LogVersion      bool          `json:"log-version"`
+	SlowThreshold   time.Duration `json:"slow-threshold"`
+	RedactHeaders   string        `json:"redact-headers"`
+	RedactParams    string        `json:"redact-params"`
+
+	TrustedProxies        string        `json:"trusted-proxies"`
+	ProxyHeaders          bool          `json:"proxy-headers"`
+	AllowedHosts          string        `json:"allowed-hosts"`
+	CORSOrigins           string        `json:"cors-origins"`
+	SecurityHeaders       bool          `json:"security-headers"`
+	Gzip                  bool          `json:"gzip"`
+	ETag                  bool          `json:"etag"`
+	CleanPath             bool          `json:"clean-path"`
+	NormalizePath         string        `json:"normalize-path"`
+	CSRF                  bool          `json:"csrf"`
+	CSRFCookie            string        `json:"csrf-cookie"`
+	CSRFHeader            string        `json:"csrf-header"`
+	MethodOverride        bool          `json:"method-override"`
+	Maintenance           bool          `json:"maintenance"`
+	MaintenanceRetryAfter time.Duration `json:"maintenance-retry-after"`
+	IdempotencyTTL        time.Duration `json:"idempotency-ttl"`
+	CacheTTL              time.Duration `json:"cache-ttl"`
+
+	AuthUsers    string `json:"auth-users"`
+	APIKeys      string `json:"api-keys"`
+	APIKeyHeader string `json:"api-key-header"`
+	APIKeyParam  string `json:"api-key-param"`
+	JWTSecret    string `json:"jwt-secret"`
+	JWTPublicKey string `json:"jwt-public-key"`
+
+	// command line only, so not in register or a config file
+	ConfigPath  string `json:"-"`
+	PrintConfig bool   `json:"-"`
+	CheckConfig bool   `json:"-"`
+}
+
+// register binds c's fields to flags on fs, using the current field values as defaults
+func (c *Config) register(fs *flag.FlagSet) {
+	fs.IntVar(&c.Port, "port", c.Port, "port to run site")
+	fs.StringVar(&c.Addr, "addr", c.Addr, "host:port to listen on, takes precedence over -port")
+	fs.StringVar(&c.UnixSocket, "unix-socket", c.UnixSocket, "path of a unix socket to listen on instead of -addr/-port")
+	fs.StringVar(&c.HTTPAddr, "http-addr", c.HTTPAddr, "host:port for an additional plain HTTP listener, e.g. :80 alongside TLS on :443")
+	fs.BoolVar(&c.HTTPSRedirect, "https-redirect", c.HTTPSRedirect, "redirect everything on -http-addr to https, except ACME challenges")
+	fs.StringVar(&c.HTTPSHost, "https-host", c.HTTPSHost, "host[:port] -https-redirect and -require-https redirect to, defaults to the request host")
+	fs.StringVar(&c.RequireHTTPS, "require-https", c.RequireHTTPS, "redirect or reject requests that did not arrive over TLS, trusting X-Forwarded-Proto from -trusted-proxies; empty allows them")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "path to a PEM certificate; serves HTTPS when set with -tls-key, both reloaded on SIGHUP")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "path to the PEM private key for -tls-cert")
+	fs.StringVar(&c.ClientCA, "client-ca", c.ClientCA, "path to a PEM CA bundle; when set, clients must present a certificate it signed")
+	fs.StringVar(&c.ACMEDomains, "acme-domains", c.ACMEDomains, "comma separated domains to get Let's Encrypt certificates for, instead of -tls-cert; needs -http-addr on port 80 for the challenges")
+	fs.StringVar(&c.ACMECacheDir, "acme-cache-dir", c.ACMECacheDir, "directory -acme-domains certificates are kept in")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", c.ShutdownTimeout, "time allowed for in-flight requests to finish on shutdown")
+	fs.DurationVar(&c.ShutdownDelay, "shutdown-delay", c.ShutdownDelay, "time between failing readiness and draining connections on shutdown")
+	fs.DurationVar(&c.HandlerTimeout, "handler-timeout", c.HandlerTimeout, "longest a handler may run before a 503, 0 for no limit; leave off for streaming routes")
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", c.ReadTimeout, "longest time to read a whole request, body included, 0 for no limit")
+	fs.DurationVar(&c.ReadHeaderTimeout, "read-header-timeout", c.ReadHeaderTimeout, "longest time to read request headers, 0 for no limit")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", c.WriteTimeout, "longest time from the end of the request headers to the end of the response, 0 for no limit")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", c.IdleTimeout, "how long idle keep-alive connections stay open, 0 for no limit")
+	fs.BoolVar(&c.DisableKeepAlive, "disable-keepalive", c.DisableKeepAlive, "close every connection after one response instead of keeping it for -idle-timeout")
+	fs.Int64Var(&c.MaxBodyBytes, "max-body-bytes", c.MaxBodyBytes, "largest request body accepted, 0 for no limit")
+	fs.IntVar(&c.MaxHeaderBytes, "max-header-bytes", c.MaxHeaderBytes, "largest total size of request headers accepted")
+	fs.IntVar(&c.MaxInflight, "max-inflight", c.MaxInflight, "most requests handled at once before answering 503, 0 for no limit")
+	fs.StringVar(&c.ContentTypes, "content-types", c.ContentTypes, "comma separated media types accepted on POST, PUT and PATCH bodies, empty to accept any")
+	fs.Float64Var(&c.RateLimit, "rate-limit", c.RateLimit, "requests per second allowed per client IP, 0 for no limit")
+	fs.IntVar(&c.RateBurst, "rate-burst", c.RateBurst, "requests a client may make at once before -rate-limit applies")
+	fs.StringVar(&c.DebugAddr, "debug-addr", c.DebugAddr, "host:port for pprof and expvar endpoints, e.g. 127.0.0.1:6060; empty disables them")
+	fs.IntVar(&c.DebugCapture, "debug-capture", c.DebugCapture, "log up to this many bytes of each request and response body, redacted; 0 disables it and it should stay off in production")
+
+	fs.StringVar(&c.HealthPath, "health-path", c.HealthPath, "path of the liveness probe")
+	fs.StringVar(&c.ReadyPath, "ready-path", c.ReadyPath, "path of the readiness probe")
+	fs.StringVar(&c.StatusPath, "status-path", c.StatusPath, "path of the JSON status endpoint, empty to disable")
+	fs.StringVar(&c.MetricsPath, "metrics-path", c.MetricsPath, "path serving prometheus metrics, empty to disable")
+	fs.StringVar(&c.StaticDir, "static-dir", c.StaticDir, "directory of static files to serve, empty to disable")
+	fs.StringVar(&c.StaticPrefix, "static-prefix", c.StaticPrefix, "path prefix the -static-dir files are served under")
+
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "lowest level logged: debug, info, warn, or error")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "json, or console for readable lines while developing")
+	fs.StringVar(&c.LogOutput, "log-output", c.LogOutput, "where logs go: stdout, stderr, or a file path to append to, reopened on SIGHUP")
+	fs.StringVar(&c.AccessLogOutput, "access-log-output", c.AccessLogOutput, "where request lines go, as for -log-output; empty keeps them with the other logs")
+	fs.StringVar(&c.AccessLogFormat, "access-log-format", c.AccessLogFormat, "json or console for -access-log-output; empty uses -log-format")
+	fs.StringVar(&c.AccessLogLevel, "access-log-level", c.AccessLogLevel, "lowest level of request line logged to -access-log-output; empty uses -log-level")
+	fs.StringVar(&c.LogFields, "log-fields", c.LogFields, "log field names to use: default, elastic, or gcp")
+	fs.BoolVar(&c.LogAsync, "log-async", c.LogAsync, "write logs from a background goroutine instead of the request")
+	fs.IntVar(&c.LogAsyncBuffer, "log-async-buffer", c.LogAsyncBuffer, "log lines -log-async holds before the buffer is full")
+	fs.BoolVar(&c.LogAsyncBlock, "log-async-block", c.LogAsyncBlock, "block requests on a full -log-async buffer instead of dropping lines")
+	fs.BoolVar(&c.LogHeaders, "log-headers", c.LogHeaders, "include request headers in the request log line")
+	fs.DurationVar(&c.SlowThreshold, "slow-threshold", c.SlowThreshold, "log requests slower than this at warn with slow:true, 0 to disable")
+	fs.BoolVar(&c.LogTTS, "log-tts", c.LogTTS, "also log the deprecated tts_ns field (milliseconds) for old dashboards")
+	fs.StringVar(&c.LogTime, "log-time", c.LogTime, "request_time format: unix, rfc3339, or both to add request_timestamp")
+	fs.IntVar(&c.LogSampleRate, "log-sample-rate", c.LogSampleRate, "log 1 in this many successful requests; errors and non-2xx responses are always logged")
+	fs.BoolVar(&c.LogVersion, "log-version", c.LogVersion, "add the build version to every log line")
+	fs.StringVar(&c.RedactHeaders, "redact-headers", c.RedactHeaders, "comma separated headers to redact from logs, in addition to Authorization, Cookie, and Set-Cookie")
+	fs.StringVar(&c.RedactParams, "redact-params", c.RedactParams, "comma separated query parameters to redact from logs, in addition to access_token and api_key")
+
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", c.TrustedProxies, "comma separated CIDRs of proxies whose X-Forwarded-For is trusted")
+	fs.BoolVar(&c.ProxyHeaders, "proxy-headers", c.ProxyHeaders, "take the client address, host, and scheme from X-Forwarded-* headers sent by -trusted-proxies")
+	fs.StringVar(&c.AllowedHosts, "allowed-hosts", c.AllowedHosts, "comma separated Host values to accept, *.example.com for any subdomain; empty accepts any")
+	fs.StringVar(&c.CORSOrigins, "cors-origins", c.CORSOrigins, "comma separated origins allowed for CORS, * for any; empty disables CORS")
+	fs.BoolVar(&c.SecurityHeaders, "security-headers", c.SecurityHeaders, "set browser security headers like X-Frame-Options on responses")
+	fs.BoolVar(&c.Gzip, "gzip", c.Gzip, "compress responses with brotli or gzip for clients that accept it")
+	fs.BoolVar(&c.ETag, "etag", c.ETag, "set ETags on GET responses and answer If-None-Match with 304")
+	fs.BoolVar(&c.CleanPath, "clean-path", c.CleanPath, "redirect paths with a trailing slash to the path without it")
+	fs.StringVar(&c.NormalizePath, "normalize-path", c.NormalizePath, "collapse duplicate slashes and resolve dot segments before routing: rewrite, or redirect to the clean path")
+	fs.BoolVar(&c.CSRF, "csrf", c.CSRF, "require a double-submit CSRF token on POST, PUT, PATCH and DELETE unless the request sends a valid -api-keys key in -api-key-header")
+	fs.StringVar(&c.CSRFCookie, "csrf-cookie", c.CSRFCookie, "name of the cookie holding the -csrf token")
+	fs.StringVar(&c.CSRFHeader, "csrf-header", c.CSRFHeader, "header clients echo the -csrf token in")
+	fs.BoolVar(&c.MethodOverride, "method-override", c.MethodOverride, "route POSTs with X-HTTP-Method-Override or a _method form field as PUT, PATCH, or DELETE")
+	fs.BoolVar(&c.Maintenance, "maintenance", c.Maintenance, "start in maintenance mode, answering app routes with 503 until turned off at /private/maintenance")
+	fs.DurationVar(&c.MaintenanceRetryAfter, "maintenance-retry-after", c.MaintenanceRetryAfter, "Retry-After sent with maintenance mode 503s")
+	fs.DurationVar(&c.IdempotencyTTL, "idempotency-ttl", c.IdempotencyTTL, "how long POST responses are kept for replay by Idempotency-Key, 0 to disable")
+	fs.DurationVar(&c.CacheTTL, "cache-ttl", c.CacheTTL, "serve repeated GETs of cacheable routes from an in-process cache for this long, 0 to disable")
+
+	fs.StringVar(&c.AuthUsers, "auth-users", c.AuthUsers, "comma separated user:password pairs allowed through basic auth")
+	fs.StringVar(&c.APIKeys, "api-keys", c.APIKeys, "comma separated identity:key pairs allowed through API key auth on /api")
+	fs.StringVar(&c.APIKeyHeader, "api-key-header", c.APIKeyHeader, "header carrying the API key")
+	fs.StringVar(&c.APIKeyParam, "api-key-param", c.APIKeyParam, "query parameter carrying the API key when the header is absent, empty to disable")
+	fs.StringVar(&c.JWTSecret, "jwt-secret", c.JWTSecret, "HMAC secret for bearer tokens on /jwt")
+	fs.StringVar(&c.JWTPublicKey, "jwt-public-key", c.JWTPublicKey, "path to a PEM RSA public key for bearer tokens on /jwt")
+}
+
+func defaultConfig() Config {
+	return Config{
+		Port:                  9126,
+		ShutdownTimeout:       15 * time.Second,
+		ReadTimeout:           30 * time.Second,
+		ReadHeaderTimeout:     10 * time.Second,
+		WriteTimeout:          60 * time.Second,
+		IdleTimeout:           120 * time.Second,
+		MaxBodyBytes:          1 << 20,
+		HealthPath:            "/healthz",
+		ReadyPath:             "/readyz",
+		MetricsPath:           "/metrics",
+		LogLevel:              "info",
+		LogAsyncBuffer:        4096,
+		SecurityHeaders:       true,
+		RateBurst:             20,
+		MaxHeaderBytes:        64 << 10,
+		StaticPrefix:          "/static/",
+		LogOutput:             "stderr",
+		CSRFCookie:            "csrf_token",
+		CSRFHeader:            "X-CSRF-Token",
+		APIKeyHeader:          "X-API-Key",
+		APIKeyParam:           "api_key",
+		StatusPath:            "/status",
+		ACMECacheDir:          "acme-cache",
+		LogFields:             "default",
+		LogTime:               "unix",
+		LogFormat:             "json",
+		LogSampleRate:         1,
+		MaintenanceRetryAfter: time.Minute,
+	}
+}
+
+// parseFlags registers every flag on flag.CommandLine and parses os.Args into
+// it, see parseFlagSet
+func parseFlags() (Config, error) {
+	return parseFlagSet(flag.CommandLine, os.Args[1:])
+}
+
+// parseFlagSet registers every flag on fs, fills them from the command line, the
+// environment, and -config in that order of precedence, and validates the result
+func parseFlagSet(fs *flag.FlagSet, args []string) (Config, error) {
+	cfg := defaultConfig()
+	cfg.register(fs)
+	fs.StringVar(&cfg.ConfigPath, "config", "", "path to a JSON or YAML file of flag values; flags and env take precedence")
+	fs.BoolVar(&cfg.PrintConfig, "print-config", false, "log the effective configuration, secrets redacted, before serving")
+	fs.BoolVar(&cfg.CheckConfig, "check-config", false, "validate the configuration and exit 0 if it's usable, 1 if not")
+	if err := flagenv.ParseSet(flagenv.Prefix, fs); err != nil {
+		return cfg, err
+	}
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	// flagenv sets values behind fs's back, so Visit doesn't see them
+	fs.VisitAll(func(f *flag.Flag) {
+		if os.Getenv(envName(f.Name)) != "" {
+			set[f.Name] = true
+		}
+	})
+	if cfg.ConfigPath != "" {
+		if err := applyConfigFile(fs, cfg.ConfigPath, set); err != nil {
+			return cfg, fmt.Errorf("invalid -config: %v", err)
+		}
+	}
+	if err := cfg.validate(set["port"]); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// envName is the variable flagenv fills the flag name from, e.g. LOG_LEVEL for
+// -log-level
+func envName(name string) string {
+	return strings.ToUpper(flagenv.Prefix + strings.NewReplacer(".", "_", "-", "_").Replace(name))
+}
+
+// validate checks ranges and combinations the flag types can't express, and
+// fills in -addr from -port. portSet says -port was given explicitly.
+func (c *Config) validate(portSet bool) error {
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("invalid -port %d: must be between 1 and 65535", c.Port)
+	}
+	if c.UnixSocket != "" {
+		if c.Addr != "" || portSet {
+			return errors.New("-unix-socket can't be combined with -addr or -port")
+		}
+	} else {
+		if c.Addr == "" {
+			c.Addr = fmt.Sprintf(":%d", c.Port)
+		}
+		if err := validateAddr(c.Addr); err != nil {
+			return fmt.Errorf("invalid -addr %q: %v", c.Addr, err)
+		}
+	}
+	if c.HTTPAddr != "" {
+		if err := validateAddr(c.HTTPAddr); err != nil {
+			return fmt.Errorf("invalid -http-addr %q: %v", c.HTTPAddr, err)
+		}
+	}
+
+	// zero turns these off, but a negative duration is always a typo
+	durations := []struct {
+		name string
+		d    time.Duration
+	}{
+		{"shutdown-timeout", c.ShutdownTimeout},
+		{"shutdown-delay", c.ShutdownDelay},
+		{"handler-timeout", c.HandlerTimeout},
+		{"read-timeout", c.ReadTimeout},
+		{"read-header-timeout", c.ReadHeaderTimeout},
+		{"write-timeout", c.WriteTimeout},
+		{"idle-timeout", c.IdleTimeout},
+		{"slow-threshold", c.SlowThreshold},
+		{"idempotency-ttl", c.IdempotencyTTL},
+		{"cache-ttl", c.CacheTTL},
+		{"maintenance-retry-after", c.MaintenanceRetryAfter},
+	}
+	for _, d := range durations {
+		if d.d < 0 {
+			return fmt.Errorf("invalid -%s %v: must not be negative", d.name, d.d)
+		}
+	}
+	counts := []struct {
+		name string
+		n    int64
+	}{
+		{"max-body-bytes", c.MaxBodyBytes},
+		{"max-header-bytes", int64(c.MaxHeaderBytes)},
+		{"max-inflight", int64(c.MaxInflight)},
+		{"rate-burst", int64(c.RateBurst)},
+		{"debug-capture", int64(c.DebugCapture)},
+	}
+	for _, n := range counts {
+		if n.n < 0 {
+			return fmt.Errorf("invalid -%s %d: must not be negative", n.name, n.n)
+		}
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("invalid -rate-limit %v: must not be negative", c.RateLimit)
+	}
+	if c.LogAsync && c.LogAsyncBuffer < 1 {
+		return fmt.Errorf("invalid -log-async-buffer %d: must be at least 1", c.LogAsyncBuffer)
+	}
+	if c.LogSampleRate < 1 {
+		return fmt.Errorf("invalid -log-sample-rate %d: must be at least 1", c.LogSampleRate)
+	}
+
+	switch c.LogFormat {
+	case "json", "console":
+	default:
+		return fmt.Errorf("invalid -log-format %q: expected json or console", c.LogFormat)
+	}
+	switch c.AccessLogFormat {
+	case "", "json", "console":
+	default:
+		return fmt.Errorf("invalid -access-log-format %q: expected json or console", c.AccessLogFormat)
+	}
+	if c.AccessLogOutput == "" && (c.AccessLogFormat != "" || c.AccessLogLevel != "") {
+		return errors.New("-access-log-format and -access-log-level need -access-log-output")
+	}
+	switch c.LogTime {
+	case "unix", "rfc3339", "both":
+	default:
+		return fmt.Errorf("invalid -log-time %q: expected unix, rfc3339, or both", c.LogTime)
+	}
+	switch c.NormalizePath {
+	case "", "rewrite", "redirect":
+	default:
+		return fmt.Errorf("invalid -normalize-path %q: expected rewrite or redirect", c.NormalizePath)
+	}
+	switch c.RequireHTTPS {
+	case "", "redirect", "reject":
+	default:
+		return fmt.Errorf("invalid -require-https %q: expected redirect or reject", c.RequireHTTPS)
+	}
+
+	if err := checkTLSFlags(c.TLSCert, c.TLSKey, c.ClientCA); err != nil {
+		return err
+	}
+	if c.ACMEDomains != "" {
+		if c.TLSCert != "" {
+			return errors.New("-acme-domains can't be combined with -tls-cert")
+		}
+		if c.HTTPAddr == "" {
+			return errors.New("-acme-domains requires -http-addr to answer HTTP-01 challenges")
+		}
+	}
+	if c.ProxyHeaders && c.TrustedProxies == "" {
+		return errors.New("-proxy-headers requires -trusted-proxies")
+	}
+	if c.JWTSecret != "" && c.JWTPublicKey != "" {
+		return errors.New("only one of -jwt-secret and -jwt-public-key may be set")
+	}
+	return nil
+}
+
+// configSecrets are settings never printed by -print-config
+var configSecrets = map[string]bool{
+	"auth-users": true,
+	"api-keys":   true,
+	"jwt-secret": true,
+}
+
+// values renders c the way it would be written in a config file, with secrets
+// redacted, for -print-config
+func (c Config) values() map[string]string {
+	fs := flag.NewFlagSet("print", flag.ContinueOnError)
+	c.register(fs)
+	out := make(map[string]string)
+	fs.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if configSecrets[f.Name] && v != "" {
+			v = redacted
+		}
+		out[f.Name] = v
+	})
+	return out
+}
+
+// loadConfig reads a JSON or YAML (by .yaml/.yml extension) config file on top of
+// the defaults. Keys are flag names; durations are strings like "15s".
+func loadConfig(path string) (Config, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet("config", flag.ContinueOnError)
+	c.register(fs)
+	err := applyConfigFile(fs, path, nil)
+	return c, err
+}
+
+// applyConfigFile sets flags on fs from the file at path, skipping the flags in
+// skip so the command line and environment take precedence. Keys that aren't
+// flags are an error rather than silently ignored.
+func applyConfigFile(fs *flag.FlagSet, path string, skip map[string]bool) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	values := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &values)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.UseNumber()
+		err = dec.Decode(&values)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to parse %s: %v", path, err)
+	}
+
+	for name, v := range values {
+		if fs.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("%s: unknown field %q", path, name)
+		}
+		if skip[name] {
+			continue
+		}
+		if err := fs.Set(name, configValue(v)); err != nil {
+			return fmt.Errorf("%s: invalid %q: %v", path, name, err)
+		}
+	}
+	return nil
+}
+
+// configValue renders a decoded file value the way it would be given as a flag.
+// Lists become comma separated.
+func configValue(v interface{}) string {
+	if list, ok := v.([]interface{}); ok {
+		s := make([]string, len(list))
+		for i, item := range list {
+			s[i] = fmt.Sprint(item)
+		}
+		return strings.Join(s, ",")
+	}
+	return fmt.Sprint(v)
+}
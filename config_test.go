@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseFlagSetPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"port": 9000, "log-level": "debug", "metrics-path": "/m"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PORT", "8081")
+	t.Setenv("LOG_LEVEL", "warn")
+
+	cfg, err := parseFlagSet(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-config", path, "-log-level", "error"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Port != 8081 || cfg.Addr != ":8081" {
+		t.Errorf("port %d, addr %q; want the environment's 8081 over the file", cfg.Port, cfg.Addr)
+	}
+	if cfg.LogLevel != "error" {
+		t.Errorf("log level %q, want the command line's error over the environment and file", cfg.LogLevel)
+	}
+	if cfg.MetricsPath != "/m" {
+		t.Errorf("metrics path %q, want the file's /m over the default", cfg.MetricsPath)
+	}
+}
+
+func TestParseFlagSetPortFromEnv(t *testing.T) {
+	t.Setenv("PORT", "8081")
+	_, err := parseFlagSet(flag.NewFlagSet("test", flag.ContinueOnError), []string{"-unix-socket", "/tmp/app.sock"})
+	if err == nil {
+		t.Error("PORT from the environment was allowed alongside -unix-socket")
+	}
+}
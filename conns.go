@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// openConns counts client connections on servers using trackConn, from accept
+// until close or hijack
+var openConns atomic.Int64
+
+// trackConn is an http.Server ConnState hook maintaining openConns
+func trackConn(_ net.Conn, state http.ConnState) {
+	switch state {
+	case http.StateNew:
+		openConns.Add(1)
+	case http.StateHijacked, http.StateClosed:
+		openConns.Add(-1)
+	}
+}
+
+// reportDraining logs the open connection count every interval until done is
+// closed, so shutdown timeouts can be tuned from how long draining really takes
+func reportDraining(done <-chan struct{}, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			logEvent(nil, "shutdown_draining", fmt.Sprintf("%d connections still open", openConns.Load()))
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+)
+
+// contextKey is the type of every context key set here. Since it's unexported,
+// no other package can collide with these keys, unlike plain strings.
+type contextKey int
+
+const (
+	logDataKey contextKey = iota
+	claimsKey
+	clientCertKey
+	peerAddrKey
+	routeFieldsKey
+)
+
+func (k contextKey) String() string {
+	switch k {
+	case logDataKey:
+		return "log"
+	case claimsKey:
+		return "claims"
+	case clientCertKey:
+		return "client_cert"
+	case peerAddrKey:
+		return "peer_addr"
+	case routeFieldsKey:
+		return "route_fields"
+	}
+	return "unknown"
+}
+
+// logDataFrom returns the log map stored in ctx, if any
+func logDataFrom(ctx context.Context) (map[string]interface{}, bool) {
+	data, ok := ctx.Value(logDataKey).(map[string]interface{})
+	return data, ok
+}
+
+// withLogData returns a copy of ctx carrying data as the log map
+func withLogData(ctx context.Context, data map[string]interface{}) context.Context {
+	return context.WithValue(ctx, logDataKey, data)
+}
+
+// routeFieldsFrom returns the routeFields stored in ctx by mwTimeout, if any
+func routeFieldsFrom(ctx context.Context) (*routeFields, bool) {
+	rf, ok := ctx.Value(routeFieldsKey).(*routeFields)
+	return rf, ok
+}
+
+// withRouteFields returns a copy of ctx carrying rf
+func withRouteFields(ctx context.Context, rf *routeFields) context.Context {
+	return context.WithValue(ctx, routeFieldsKey, rf)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+var (
+	corsAllowMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders = "Accept, Authorization, Content-Type, X-Request-ID"
+	corsMaxAge       = "600"
+)
+
+// mwCORS allows cross-origin requests from the listed origins. An origin of "*"
+// allows any origin. Preflight requests are answered here and never reach h.
+func mwCORS(origins []string) func(http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(origins))
+	var anyOrigin bool
+	for _, o := range origins {
+		o = strings.TrimSpace(o)
+		if o == "*" {
+			anyOrigin = true
+		}
+		allowed[o] = true
+	}
+
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			w.Header().Add("Vary", "Origin")
+			if origin == "" || !(anyOrigin || allowed[origin]) {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			if anyOrigin {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+			} else {
+				w.Header().Set("Access-Control-Allow-Origin", origin)
+			}
+
+			if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+				w.Header().Add("Vary", "Access-Control-Request-Method")
+				w.Header().Add("Vary", "Access-Control-Request-Headers")
+				w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+				w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+				w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			h.ServeHTTP(w, r)
+		})
+	}
+}
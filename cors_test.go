@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMwCORSPreflight(t *testing.T) {
+	var reached bool
+	h := mwCORS([]string{"https://app.example", " https://admin.example"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	req := httptest.NewRequest("OPTIONS", "/x", nil)
+	req.Header.Set("Origin", "https://admin.example")
+	req.Header.Set("Access-Control-Request-Method", "PUT")
+
+	rec := serve(h, req)
+	if rec.Code != http.StatusNoContent || reached {
+		t.Fatalf("preflight got %d, reached handler %v; want a 204 answered by mwCORS", rec.Code, reached)
+	}
+	if got := rec.Header().Get("Access-Control-Allow-Origin"); got != "https://admin.example" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+	if rec.Header().Get("Access-Control-Allow-Methods") != corsAllowMethods || rec.Header().Get("Access-Control-Allow-Headers") != corsAllowHeaders {
+		t.Errorf("preflight is missing the allowed methods or headers: %v", rec.Header())
+	}
+}
+
+func TestMwCORSSimpleRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		origins []string
+		origin  string
+		want    string
+	}{
+		{"listed origin is echoed", []string{"https://app.example"}, "https://app.example", "https://app.example"},
+		{"unlisted origin gets nothing", []string{"https://app.example"}, "https://evil.example", ""},
+		{"no origin", []string{"https://app.example"}, "", ""},
+		{"wildcard", []string{"*"}, "https://anything.example", "*"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var reached bool
+			h := mwCORS(tt.origins)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reached = true
+			}))
+			req := httptest.NewRequest("GET", "/x", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
+			}
+			rec := serve(h, req)
+			if !reached {
+				t.Error("request didn't reach the handler")
+			}
+			if got := rec.Header().Get("Access-Control-Allow-Origin"); got != tt.want {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.want)
+			}
+			if rec.Header().Get("Vary") != "Origin" {
+				t.Errorf("Vary = %q, want Origin", rec.Header().Values("Vary"))
+			}
+		})
+	}
+}
+
+func TestMwCORSUnlistedPreflightPassesThrough(t *testing.T) {
+	var reached bool
+	h := mwCORS([]string{"https://app.example"})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reached = true
+	}))
+	req := httptest.NewRequest("OPTIONS", "/x", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	req.Header.Set("Access-Control-Request-Method", "DELETE")
+	if rec := serve(h, req); !reached || rec.Header().Get("Access-Control-Allow-Methods") != "" {
+		t.Errorf("an unlisted origin's preflight was answered by mwCORS")
+	}
+}
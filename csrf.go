@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+)
+
+// mwCSRF guards cookie-authenticated routes with a double-submit cookie. Every
+// response carries a random token in cookieName; browsers' same-origin rules mean
+// only our own pages can read it back, so unsafe methods must echo it in the
+// headerName header or get a 403. The cookie isn't HttpOnly since page scripts
+// need to read it. A request whose apiKeyHeader holds one of keys (see
+// parseAPIKeys) is passed through untouched, since API clients have no cookie to
+// echo and a forger doesn't know a key. Nothing weaker counts: browsers resend
+// Basic credentials on their own, and a forged form can put any query string
+// in its action URL.
+func mwCSRF(cookieName, headerName string, keys map[string]string, apiKeyHeader string) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sent := r.Header.Get(apiKeyHeader); sent != "" {
+				if _, ok := lookupAPIKey(keys, sent); ok {
+					h.ServeHTTP(w, r)
+					return
+				}
+			}
+			token := ""
+			if c, err := r.Cookie(cookieName); err == nil && len(c.Value) == 64 {
+				token = c.Value
+			}
+			if token == "" {
+				token = newCSRFToken()
+				http.SetCookie(w, &http.Cookie{
+					Name:     cookieName,
+					Value:    token,
+					Path:     "/",
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteLaxMode,
+				})
+			}
+
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			default:
+				sent := r.Header.Get(headerName)
+				if sent == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(token)) != 1 {
+					logEvent(r, "csrf_rejected", "missing or mismatched "+headerName)
+					writeJSON(w, r, http.StatusForbidden, map[string]string{"error": "invalid csrf token"})
+					return
+				}
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+func newCSRFToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMwCSRF(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwCSRF("csrf_token", "X-CSRF-Token", map[string]string{"k1": "svc"}, "X-API-Key")(http.HandlerFunc(anotherHandler))
+
+	first := serve(h, httptest.NewRequest("GET", "/", nil))
+	cookies := first.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "csrf_token" || len(cookies[0].Value) != 64 {
+		t.Fatalf("GET didn't hand out a token: %v", cookies)
+	}
+	token := cookies[0].Value
+
+	post := func(header string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/", nil)
+		req.AddCookie(&http.Cookie{Name: "csrf_token", Value: token})
+		if header != "" {
+			req.Header.Set("X-CSRF-Token", header)
+		}
+		return serve(h, req)
+	}
+	if rec := post(token); rec.Code != http.StatusOK {
+		t.Errorf("POST echoing the token got %d, want 200", rec.Code)
+	}
+	if rec := post(token); len(rec.Result().Cookies()) != 0 {
+		t.Error("a valid token was replaced")
+	}
+	for name, header := range map[string]string{"missing": "", "forged": newCSRFToken()} {
+		if rec := post(header); rec.Code != http.StatusForbidden {
+			t.Errorf("%s token got %d, want 403", name, rec.Code)
+		}
+	}
+	if n := len(logs.events("csrf_rejected")); n != 2 {
+		t.Errorf("logged %d csrf_rejected events, want 2", n)
+	}
+}
+
+func TestMwCSRFSkipsValidAPIKeys(t *testing.T) {
+	captureLogs(t)
+	h := mwCSRF("csrf_token", "X-CSRF-Token", map[string]string{"k1": "svc"}, "X-API-Key")(http.HandlerFunc(anotherHandler))
+	tests := []struct {
+		name string
+		url  string
+		set  func(*http.Request)
+		want int
+	}{
+		{"valid api key header", "/", func(r *http.Request) { r.Header.Set("X-API-Key", "k1") }, http.StatusOK},
+		{"invalid api key header", "/", func(r *http.Request) { r.Header.Set("X-API-Key", "nope") }, http.StatusForbidden},
+		{"api key param", "/?api_key=k1", func(r *http.Request) {}, http.StatusForbidden},
+		{"authorization", "/", func(r *http.Request) { r.SetBasicAuth("bob", "pw") }, http.StatusForbidden},
+		// a cookie alone is exactly what a forged request carries
+		{"cookie", "/", func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "session", Value: "1"}) }, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.url, nil)
+			tt.set(req)
+			if rec := serve(h, req); rec.Code != tt.want {
+				t.Errorf("got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
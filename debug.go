@@ -0,0 +1,47 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+	"time"
+)
+
+// newDebugServer serves pprof under /debug/pprof/, expvar at /debug/vars, and
+// runtimeHandler at /debug/runtime. It has its own mux so none of this is ever
+// mounted on the public router.
+func newDebugServer(addr string) *http.Server {
+	m := http.NewServeMux()
+	m.HandleFunc("/debug/pprof/", pprof.Index)
+	m.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	m.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	m.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	m.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	m.Handle("/debug/vars", expvar.Handler())
+	m.HandleFunc("/debug/runtime", runtimeHandler)
+	return &http.Server{Addr: addr, Handler: m}
+}
+
+// runtimeHandler is a quick look at the process's health, for when Prometheus is
+// more than you want. ReadMemStats stops the world briefly, which is part of why
+// it's only on the debug listener.
+func runtimeHandler(w http.ResponseWriter, r *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	var lastPause uint64
+	if m.NumGC > 0 {
+		lastPause = m.PauseNs[(m.NumGC+255)%256]
+	}
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"goroutines":        runtime.NumGoroutine(),
+		"heap_alloc_bytes":  m.HeapAlloc,
+		"heap_sys_bytes":    m.HeapSys,
+		"heap_objects":      m.HeapObjects,
+		"num_gc":            m.NumGC,
+		"gc_pause_total_ns": m.PauseTotalNs,
+		"gc_pause_last_ns":  lastPause,
+		"gc_cpu_fraction":   m.GCCPUFraction,
+		"uptime_seconds":    time.Since(startTime).Seconds(),
+	})
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+)
+
+func TestRuntimeHandler(t *testing.T) {
+	runtime.GC()
+	rec := serve(http.HandlerFunc(runtimeHandler), httptest.NewRequest("GET", "/debug/runtime", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("code = %d", rec.Code)
+	}
+	var stats map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	for _, field := range []string{
+		"goroutines", "heap_alloc_bytes", "heap_sys_bytes", "heap_objects", "num_gc",
+		"gc_pause_total_ns", "gc_pause_last_ns", "gc_cpu_fraction", "uptime_seconds",
+	} {
+		if _, ok := stats[field].(float64); !ok {
+			t.Errorf("%s = %#v, want a number", field, stats[field])
+		}
+	}
+	if stats["goroutines"].(float64) < 1 || stats["num_gc"].(float64) < 1 {
+		t.Errorf("goroutines %v, num_gc %v after a forced GC", stats["goroutines"], stats["num_gc"])
+	}
+}
+
+func TestDebugServerOnlyServesDebug(t *testing.T) {
+	h := newDebugServer("localhost:0").Handler
+	if rec := serve(h, httptest.NewRequest("GET", "/debug/runtime", nil)); rec.Code != http.StatusOK {
+		t.Errorf("/debug/runtime got %d", rec.Code)
+	}
+	if rec := serve(h, httptest.NewRequest("GET", "/version", nil)); rec.Code != http.StatusNotFound {
+		t.Errorf("the debug listener served /version with %d", rec.Code)
+	}
+}
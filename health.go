@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// startTime is when the process started, set at the top of main
+var startTime time.Time
+
+// ready reports whether the server should receive new traffic. It is set once the
+// server starts and cleared when graceful shutdown begins.
+var ready atomic.Bool
+
+// setReady flips the readiness probe between 200 and 503
+func setReady(v bool) {
+	ready.Store(v)
+}
+
+// mwHealth answers liveness probes at healthPath and readiness probes at readyPath
+// before the request reaches logging or auth, so frequent probes don't flood the logs
+func mwHealth(healthPath, readyPath string) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case healthPath:
+				healthHandler(w, r)
+			case readyPath:
+				readyHandler(w, r)
+			default:
+				h.ServeHTTP(w, r)
+			}
+		})
+	}
+}
+
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !ready.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("shutting down"))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("ok"))
+}
+
+// statusHandler reports more than the probes do, for people rather than load
+// balancers: the build version, uptime, and whether the server is ready
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, map[string]interface{}{
+		"status":         "ok",
+		"uptime_seconds": int64(time.Since(startTime).Seconds()),
+		"version":        version,
+		"ready":          ready.Load(),
+	})
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMwHealthLiveness(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwHealth("/healthz", "/readyz")(mwLog(mwAuth(http.HandlerFunc(anotherHandler))))
+
+	rec := serve(h, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "ok" {
+		t.Errorf("/healthz got %d %q, want 200 ok without credentials", rec.Code, rec.Body.String())
+	}
+	if n := len(logs.events("request")); n != 0 {
+		t.Errorf("the probe logged %d request lines", n)
+	}
+	if rec := serve(h, httptest.NewRequest("GET", "/other", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("/other got %d, want it passed on to the app", rec.Code)
+	}
+}
+
+func TestStatusHandler(t *testing.T) {
+	savedStart, savedReady := startTime, ready.Load()
+	startTime = time.Now().Add(-90 * time.Second)
+	ready.Store(true)
+	t.Cleanup(func() { startTime = savedStart; ready.Store(savedReady) })
+
+	rec := serve(http.HandlerFunc(statusHandler), httptest.NewRequest("GET", "/status", nil))
+	var body map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("status isn't JSON: %q", rec.Body.String())
+	}
+	if body["status"] != "ok" || body["version"] != version || body["ready"] != true {
+		t.Errorf("status = %v", body)
+	}
+	if up, ok := body["uptime_seconds"].(float64); !ok || up < 90 {
+		t.Errorf("uptime_seconds = %v, want at least 90", body["uptime_seconds"])
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	saved := ready.Load()
+	t.Cleanup(func() { ready.Store(saved) })
+	h := mwHealth("/healthz", "/readyz")(http.NotFoundHandler())
+
+	for _, tt := range []struct {
+		ready bool
+		code  int
+	}{{true, http.StatusOK}, {false, http.StatusServiceUnavailable}} {
+		setReady(tt.ready)
+		if rec := serve(h, httptest.NewRequest("GET", "/readyz", nil)); rec.Code != tt.code {
+			t.Errorf("ready %v: /readyz got %d, want %d", tt.ready, rec.Code, tt.code)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// shutdownHook cleans up a resource, such as a database pool, once the servers
+// have drained
+type shutdownHook struct {
+	name string
+	fn   func(ctx context.Context) error
+}
+
+var (
+	shutdownHooksMu sync.Mutex
+	shutdownHooks   []shutdownHook
+)
+
+// onShutdown registers fn to run during shutdown. Hooks run one at a time in the
+// reverse order they were registered, so things opened later are closed first.
+func onShutdown(name string, fn func(ctx context.Context) error) {
+	shutdownHooksMu.Lock()
+	defer shutdownHooksMu.Unlock()
+	shutdownHooks = append(shutdownHooks, shutdownHook{name: name, fn: fn})
+}
+
+// runShutdownHooks runs the registered hooks, logging how long each took. A hook
+// still running when ctx is done is abandoned, and the rest are still started so
+// they can see ctx is done and clean up what they can.
+func runShutdownHooks(ctx context.Context) {
+	shutdownHooksMu.Lock()
+	hooks := append([]shutdownHook(nil), shutdownHooks...)
+	shutdownHooksMu.Unlock()
+
+	for i := len(hooks) - 1; i >= 0; i-- {
+		hook := hooks[i]
+		start := time.Now()
+		done := make(chan error, 1)
+		go func() {
+			done <- hook.fn(ctx)
+		}()
+
+		var err error
+		select {
+		case err = <-done:
+		case <-ctx.Done():
+			// a hook that returns straight away on a done ctx still gets to report
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Millisecond):
+				err = fmt.Errorf("abandoned: %w", ctx.Err())
+			}
+		}
+
+		fields := map[string]interface{}{
+			"event":       "shutdown_hook",
+			"hook":        hook.name,
+			"duration_ms": float64(time.Since(start)) / float64(time.Millisecond),
+		}
+		level := levelInfo
+		if err != nil {
+			level = levelError
+			fields["error"] = err.Error()
+		}
+		logAt(level, fields)
+	}
+}
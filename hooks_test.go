@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// withShutdownHooks starts the test with no hooks registered, restoring them after
+func withShutdownHooks(t *testing.T) {
+	t.Helper()
+	saved := shutdownHooks
+	shutdownHooks = nil
+	t.Cleanup(func() { shutdownHooks = saved })
+}
+
+func TestShutdownHooksRunInReverse(t *testing.T) {
+	logs := captureLogs(t)
+	withShutdownHooks(t)
+	var order []string
+	for _, name := range []string{"db", "cache", "queue"} {
+		onShutdown(name, func(ctx context.Context) error {
+			order = append(order, name)
+			if name == "cache" {
+				return errors.New("flush failed")
+			}
+			return nil
+		})
+	}
+
+	runShutdownHooks(context.Background())
+	if len(order) != 3 || order[0] != "queue" || order[1] != "cache" || order[2] != "db" {
+		t.Errorf("ran %v, want queue, cache, db", order)
+	}
+	lines := logs.events("shutdown_hook")
+	if len(lines) != 3 {
+		t.Fatalf("logged %d shutdown_hook events, want 3", len(lines))
+	}
+	for _, line := range lines {
+		if _, ok := line["duration_ms"].(float64); !ok {
+			t.Errorf("%v has no duration_ms", line["hook"])
+		}
+		if (line["hook"] == "cache") != (line["error"] == "flush failed") {
+			t.Errorf("%v logged error %v", line["hook"], line["error"])
+		}
+	}
+}
+
+func TestShutdownHooksRespectDeadline(t *testing.T) {
+	logs := captureLogs(t)
+	withShutdownHooks(t)
+	var sawDone bool
+	onShutdown("after", func(ctx context.Context) error {
+		sawDone = ctx.Err() != nil
+		return ctx.Err()
+	})
+	onShutdown("stuck", func(ctx context.Context) error {
+		time.Sleep(time.Second)
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	runShutdownHooks(ctx)
+	if took := time.Since(start); took > 500*time.Millisecond {
+		t.Errorf("shutdown waited %v on a stuck hook", took)
+	}
+	if !sawDone {
+		t.Error("the hook after the stuck one didn't run with the done context")
+	}
+	for _, line := range logs.events("shutdown_hook") {
+		if line["error"] == nil {
+			t.Errorf("%v reported no error past the deadline", line["hook"])
+		}
+	}
+}
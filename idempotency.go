@@ -0,0 +1,229 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// idempotencyMaxBody is the largest response mwIdempotency keeps for replay.
+// Bigger responses are sent but not stored, so a retry runs the handler again.
+var idempotencyMaxBody = 1 << 20
+
+// idempotentEntry is what's stored under an Idempotency-Key: the hash of the
+// request that claimed it and, once done, the response to replay
+type idempotentEntry struct {
+	hash   string
+	done   bool
+	code   int
+	header http.Header
+	body   []byte
+}
+
+// idempotencyStore keeps idempotentEntries. Implementations must be safe for
+// concurrent use; memoryIdempotencyStore is the in-process one.
+type idempotencyStore interface {
+	// Reserve claims key for a request hashing to hash, for ttl. If the key is
+	// already claimed it returns the existing entry and false instead.
+	Reserve(key, hash string, ttl time.Duration) (*idempotentEntry, bool)
+	// Complete stores the response for a reserved key
+	Complete(key string, e *idempotentEntry)
+	// Release forgets key so the request can be retried
+	Release(key string)
+}
+
+// mwIdempotency makes POSTs carrying an Idempotency-Key header safe to retry: the
+// first response for a key is stored for ttl and replayed for repeats, marked
+// with Idempotent-Replayed. Reusing a key for a different request, or while the
+// first is still running, gets a 409. Server errors and panics aren't stored, so
+// those can be retried for real. Keys are scoped to the caller, see callerScope,
+// so one client can't replay or block another's.
+func mwIdempotency(store idempotencyStore, ttl time.Duration, apiKeyHeader, apiKeyParam string) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get("Idempotency-Key")
+			if r.Method != http.MethodPost || key == "" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > 255 {
+				writeJSON(w, r, http.StatusBadRequest, map[string]string{"error": "Idempotency-Key is too long"})
+				return
+			}
+
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				code := http.StatusBadRequest
+				var maxErr *http.MaxBytesError
+				if errors.As(err, &maxErr) {
+					code = http.StatusRequestEntityTooLarge
+				}
+				writeJSON(w, r, code, map[string]string{"error": "unable to read request body"})
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			sum := sha256.New()
+			io.WriteString(sum, r.URL.RequestURI()+"\n")
+			sum.Write(body)
+			hash := hex.EncodeToString(sum.Sum(nil))
+
+			logDataAdd(r, "idempotency_key", key)
+			key = callerScope(r, apiKeyHeader, apiKeyParam) + ":" + key
+			existing, ok := store.Reserve(key, hash, ttl)
+			if !ok {
+				switch {
+				case existing.hash != hash:
+					logEvent(r, "idempotency_conflict", "Idempotency-Key reused for a different request")
+					writeJSON(w, r, http.StatusConflict, map[string]string{"error": "Idempotency-Key was used for a different request"})
+				case !existing.done:
+					writeJSON(w, r, http.StatusConflict, map[string]string{"error": "a request with this Idempotency-Key is in progress"})
+				default:
+					for k, v := range existing.header {
+						w.Header()[k] = v
+					}
+					w.Header().Set("Idempotent-Replayed", "true")
+					w.WriteHeader(existing.code)
+					w.Write(existing.body)
+				}
+				return
+			}
+
+			// released unless completed, including when the handler panics
+			completed := false
+			defer func() {
+				if !completed {
+					store.Release(key)
+				}
+			}()
+
+			rec := &idempotencyRecorder{ResponseWriter: w, code: http.StatusOK}
+			h.ServeHTTP(rec, r)
+
+			if rec.code >= 500 || rec.overflow {
+				return
+			}
+			header := w.Header().Clone()
+			// the replay carries its own request ID
+			header.Del("X-Request-ID")
+			store.Complete(key, &idempotentEntry{
+				hash:   hash,
+				done:   true,
+				code:   rec.code,
+				header: header,
+				body:   rec.body.Bytes(),
+			})
+			completed = true
+		})
+	}
+}
+
+// callerScope identifies who sent r, before auth has run: a hash of their
+// Authorization header or API key when they send one, otherwise their clientIP
+func callerScope(r *http.Request, apiKeyHeader, apiKeyParam string) string {
+	credential := r.Header.Get("Authorization")
+	if credential == "" && apiKeyHeader != "" {
+		credential = r.Header.Get(apiKeyHeader)
+	}
+	if credential == "" && apiKeyParam != "" {
+		credential = r.URL.Query().Get(apiKeyParam)
+	}
+	if credential == "" {
+		return "ip:" + clientIP(r)
+	}
+	sum := sha256.Sum256([]byte(credential))
+	return "auth:" + hex.EncodeToString(sum[:])
+}
+
+// idempotencyRecorder copies the response on its way to the client
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	code        int
+	wroteHeader bool
+	body        bytes.Buffer
+	overflow    bool
+}
+
+func (i *idempotencyRecorder) WriteHeader(code int) {
+	if !i.wroteHeader {
+		i.wroteHeader = true
+		i.code = code
+	}
+	i.ResponseWriter.WriteHeader(code)
+}
+
+func (i *idempotencyRecorder) Write(b []byte) (int, error) {
+	i.wroteHeader = true
+	if !i.overflow {
+		if i.body.Len()+len(b) > idempotencyMaxBody {
+			i.overflow = true
+			i.body.Reset()
+		} else {
+			i.body.Write(b)
+		}
+	}
+	return i.ResponseWriter.Write(b)
+}
+
+func (i *idempotencyRecorder) Flush() {
+	if f, ok := i.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// memoryIdempotencyStore keeps entries in a map, dropping expired ones as it goes.
+// Entries aren't shared between instances, so put a shared store behind the
+// interface when running more than one.
+type memoryIdempotencyStore struct {
+	mu        sync.Mutex
+	entries   map[string]*memoryIdempotencyEntry
+	lastSweep time.Time
+}
+
+type memoryIdempotencyEntry struct {
+	*idempotentEntry
+	expires time.Time
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{entries: make(map[string]*memoryIdempotencyEntry)}
+}
+
+func (m *memoryIdempotencyStore) Reserve(key, hash string, ttl time.Duration) (*idempotentEntry, bool) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if now.Sub(m.lastSweep) > time.Minute {
+		for k, e := range m.entries {
+			if now.After(e.expires) {
+				delete(m.entries, k)
+			}
+		}
+		m.lastSweep = now
+	}
+
+	if e, ok := m.entries[key]; ok && now.Before(e.expires) {
+		return e.idempotentEntry, false
+	}
+	m.entries[key] = &memoryIdempotencyEntry{idempotentEntry: &idempotentEntry{hash: hash}, expires: now.Add(ttl)}
+	return nil, true
+}
+
+func (m *memoryIdempotencyStore) Complete(key string, e *idempotentEntry) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if cur, ok := m.entries[key]; ok {
+		cur.idempotentEntry = e
+	}
+}
+
+func (m *memoryIdempotencyStore) Release(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.entries, key)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func idempotentPost(body, key string) *http.Request {
+	req := httptest.NewRequest("POST", "/things", strings.NewReader(body))
+	req.Header.Set("Idempotency-Key", key)
+	return req
+}
+
+func TestMwIdempotencyReplay(t *testing.T) {
+	var n int
+	h := mwIdempotency(newMemoryIdempotencyStore(), time.Minute, "X-API-Key", "api_key")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		w.Header().Set("Location", fmt.Sprintf("/things/%d", n))
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "created %d", n)
+	}))
+
+	first := serve(h, idempotentPost(`{"a":1}`, "k1"))
+	replay := serve(h, idempotentPost(`{"a":1}`, "k1"))
+	if n != 1 {
+		t.Fatalf("handler ran %d times, want once", n)
+	}
+	if replay.Code != first.Code || replay.Body.String() != first.Body.String() || replay.Header().Get("Location") != "/things/1" {
+		t.Errorf("replay = %d %q, want %d %q", replay.Code, replay.Body.String(), first.Code, first.Body.String())
+	}
+	if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Error("replay isn't marked Idempotent-Replayed")
+	}
+}
+
+func TestMwIdempotencyConflict(t *testing.T) {
+	captureLogs(t)
+	h := mwIdempotency(newMemoryIdempotencyStore(), time.Minute, "", "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+
+	serve(h, idempotentPost(`{"a":1}`, "k1"))
+	if rec := serve(h, idempotentPost(`{"a":2}`, "k1")); rec.Code != http.StatusConflict {
+		t.Errorf("reusing the key for another body got %d, want 409", rec.Code)
+	}
+}
+
+func TestMwIdempotencyInProgress(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	h := mwIdempotency(newMemoryIdempotencyStore(), time.Minute, "", "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		serve(h, idempotentPost("x", "k1"))
+		close(done)
+	}()
+	<-started
+	if rec := serve(h, idempotentPost("x", "k1")); rec.Code != http.StatusConflict {
+		t.Errorf("retry while the first is running got %d, want 409", rec.Code)
+	}
+	close(release)
+	<-done
+}
+
+func TestMwIdempotencyRetriesFailures(t *testing.T) {
+	tests := map[string]http.HandlerFunc{
+		"server error": func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) },
+		"panic":        func(w http.ResponseWriter, r *http.Request) { panic("boom") },
+	}
+	for name, fail := range tests {
+		t.Run(name, func(t *testing.T) {
+			captureLogs(t)
+			failing := true
+			h := mwPanic(mwIdempotency(newMemoryIdempotencyStore(), time.Minute, "", "")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if failing {
+					fail(w, r)
+					return
+				}
+				w.WriteHeader(http.StatusCreated)
+			})))
+
+			serve(h, idempotentPost("x", "k1"))
+			failing = false
+			if rec := serve(h, idempotentPost("x", "k1")); rec.Code != http.StatusCreated {
+				t.Errorf("retry got %d, want the handler to run again", rec.Code)
+			}
+		})
+	}
+}
+
+func TestMwIdempotencyScopedToCaller(t *testing.T) {
+	var n int
+	h := mwIdempotency(newMemoryIdempotencyStore(), time.Minute, "X-API-Key", "api_key")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n++
+		fmt.Fprintf(w, "for %s", r.Header.Get("X-API-Key"))
+	}))
+
+	alice := idempotentPost("x", "k1")
+	alice.Header.Set("X-API-Key", "alice")
+	serve(h, alice)
+
+	bob := idempotentPost("x", "k1")
+	bob.Header.Set("X-API-Key", "bob")
+	rec := serve(h, bob)
+	if n != 2 || rec.Body.String() != "for bob" {
+		t.Errorf("second caller got %q after %d calls, want their own response", rec.Body.String(), n)
+	}
+
+	other := idempotentPost("x", "k1")
+	other.RemoteAddr = "192.0.2.9:1234"
+	if rec := serve(h, other); rec.Header().Get("Idempotent-Replayed") != "" {
+		t.Error("an anonymous client was replayed another caller's response")
+	}
+}
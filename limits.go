@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mwMaxBody caps request bodies at limit bytes. Requests that declare a larger
+// Content-Length are rejected with a 413 up front. Bodies of unknown length are
+// cut off once they pass the limit: reads return an *http.MaxBytesError, and the
+// handler is responsible for turning that into a 413.
+func mwMaxBody(limit int64) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.ContentLength > limit {
+				logEvent(r, "body_too_large", fmt.Sprintf("content length %d exceeds limit of %d bytes", r.ContentLength, limit))
+				writeJSON(w, r, http.StatusRequestEntityTooLarge, map[string]string{"error": "request body too large"})
+				return
+			}
+			r.Body = &maxBodyReader{ReadCloser: http.MaxBytesReader(w, r.Body, limit), r: r}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// maxBodyReader logs the first time a body runs past its limit
+type maxBodyReader struct {
+	io.ReadCloser
+	r      *http.Request
+	logged bool
+}
+
+func (m *maxBodyReader) Read(p []byte) (int, error) {
+	n, err := m.ReadCloser.Read(p)
+	var tooLarge *http.MaxBytesError
+	if !m.logged && errors.As(err, &tooLarge) {
+		m.logged = true
+		logEvent(m.r, "body_too_large", fmt.Sprintf("body exceeds limit of %d bytes", tooLarge.Limit))
+	}
+	return n, err
+}
+
+// mwTimeout responds with a 503 when h takes longer than d. h's request context
+// carries the deadline (see handlerDeadline), so outbound calls made with it, e.g.
+// http.NewRequestWithContext(r.Context(), ...), are canceled once the budget is
+// spent instead of outliving the request. It buffers the
+// response, so it belongs inside mwLog (so timeouts are logged with their status)
+// and mwPanic (panics in h are re-raised here), and can't be used for streaming.
+// The 503 is a JSON error like every other, see timeoutJSONWriter.
+func mwTimeout(d time.Duration) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		th := http.TimeoutHandler(h, d, `{"error":"handler timeout"}`+"\n")
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			logDataAdd(r, "handler_timeout_ms", d.Milliseconds())
+
+			ctx, cancel := handlerDeadline(r.Context(), time.Now(), d)
+			defer cancel()
+
+			// h may keep running after a timeout, so it gets its own copy of the log
+			// data, merged back only once it's known to be done with it. What mwRoute
+			// found is kept in routed too, so a timed out request is still logged
+			// under its route.
+			data := logDataCopy(r)
+			routed := &routeFields{fields: make(map[string]interface{})}
+			th.ServeHTTP(timeoutJSONWriter{w, ctx}, logDataReplace(r.WithContext(withRouteFields(ctx, routed)), data))
+
+			if ctx.Err() != nil {
+				routed.mu.Lock()
+				for k, v := range routed.fields {
+					logDataAdd(r, k, v)
+				}
+				routed.mu.Unlock()
+				if ctx.Err() == context.DeadlineExceeded {
+					logDataAdd(r, "timed_out", true)
+				}
+				return
+			}
+			for k, v := range data {
+				logDataAdd(r, k, v)
+			}
+		})
+	}
+}
+
+// routeFields holds the log fields mwRoute sets behind mwTimeout, guarded by mu
+// since h may still be running when mwTimeout reads them
+type routeFields struct {
+	mu     sync.Mutex
+	fields map[string]interface{}
+}
+
+// timeoutJSONWriter labels http.TimeoutHandler's 503 as JSON. The timeout body is
+// written straight to the underlying writer with whatever headers it already had,
+// so the Content-Type is set here: on a 503 sent after ctx, which ends no later
+// than TimeoutHandler's own deadline, that doesn't already have one.
+type timeoutJSONWriter struct {
+	http.ResponseWriter
+	ctx context.Context
+}
+
+func (w timeoutJSONWriter) WriteHeader(code int) {
+	if code == http.StatusServiceUnavailable && w.ctx.Err() != nil && w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// handlerDeadline derives a context that ends timeout after start, so work begun
+// late in a request only gets what is left of the budget. Canceling it, or the
+// deadline passing, cancels every outbound request made with it.
+func handlerDeadline(parent context.Context, start time.Time, timeout time.Duration) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(parent, start.Add(timeout))
+}
+
+// timeRemaining is how long r has left before its deadline. ok is false when the
+// request has no deadline, e.g. when -handler-timeout is off.
+func timeRemaining(r *http.Request) (remaining time.Duration, ok bool) {
+	deadline, ok := r.Context().Deadline()
+	if !ok {
+		return 0, false
+	}
+	return time.Until(deadline), true
+}
+
+// inflight is the number of requests currently inside mwLimit
+var inflight atomic.Int64
+
+// mwLimit allows at most max requests to be handled at once; the rest get a 503
+// right away rather than queueing. A max of 0 only counts in-flight requests.
+func mwLimit(max int) middleware {
+	var sem chan struct{}
+	if max > 0 {
+		sem = make(chan struct{}, max)
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if sem != nil {
+				select {
+				case sem <- struct{}{}:
+					defer func() { <-sem }()
+				default:
+					logDataAdd(r, "over_capacity", true)
+					writeJSON(w, r, http.StatusServiceUnavailable, map[string]string{"error": "server busy"})
+					return
+				}
+			}
+
+			inflight.Add(1)
+			defer inflight.Add(-1)
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// reportInflight logs the in-flight request count every interval until ctx is done
+func reportInflight(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			logEvent(nil, "inflight", fmt.Sprintf("%d requests in flight", inflight.Load()))
+		}
+	}
+}
+
+// mwMaxHeaderBytes rejects requests whose headers add up to more than limit bytes
+// with a 431. Server.MaxHeaderBytes already caps headers at the transport, but
+// net/http allows 4KB of slack past it and it can only be set server wide; this
+// enforces the exact figure and can be tightened per route.
+func mwMaxHeaderBytes(limit int) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if n := headerBytes(r.Header); n > limit {
+				logEvent(r, "headers_too_large", fmt.Sprintf("%d header bytes exceeds limit of %d", n, limit))
+				writeJSON(w, r, http.StatusRequestHeaderFieldsTooLarge, map[string]string{"error": "request headers too large"})
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+// headerBytes approximates the wire size of hdr as "Key: value\r\n" lines
+func headerBytes(hdr http.Header) int {
+	n := 0
+	for k, vs := range hdr {
+		for _, v := range vs {
+			n += len(k) + len(v) + 4
+		}
+	}
+	return n
+}
+
+// mwRequireContentType rejects POST, PUT and PATCH requests with a body whose
+// media type isn't one of types, with a 415. Parameters such as charset are
+// ignored, so "application/json; charset=utf-8" matches "application/json".
+// Other methods and empty bodies pass through.
+func mwRequireContentType(types ...string) middleware {
+	allowed := make(map[string]bool, len(types))
+	for _, t := range types {
+		allowed[strings.ToLower(strings.TrimSpace(t))] = true
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodPost, http.MethodPut, http.MethodPatch:
+			default:
+				h.ServeHTTP(w, r)
+				return
+			}
+			if r.ContentLength == 0 {
+				h.ServeHTTP(w, r)
+				return
+			}
+
+			ct := r.Header.Get("Content-Type")
+			mediaType, _, err := mime.ParseMediaType(ct)
+			if err != nil || !allowed[mediaType] {
+				logEvent(r, "unsupported_content_type", fmt.Sprintf("rejected Content-Type %q", ct))
+				writeJSON(w, r, http.StatusUnsupportedMediaType, map[string]string{"error": "unsupported content type"})
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMwTimeout(t *testing.T) {
+	captureLogs(t)
+	h := mwTimeout(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			<-r.Context().Done()
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "fast")
+	}))
+
+	rec := serve(h, httptest.NewRequest("GET", "/slow", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("timeout got %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] != "handler timeout" {
+		t.Errorf("timeout body %q isn't the JSON error", rec.Body.String())
+	}
+
+	rec = serve(h, httptest.NewRequest("GET", "/fast", nil))
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/plain" || rec.Body.String() != "fast" {
+		t.Errorf("fast request got %d %q, Content-Type %q", rec.Code, rec.Body.String(), rec.Header().Get("Content-Type"))
+	}
+}
+
+func TestMwTimeoutKeepsRoute(t *testing.T) {
+	logs := captureLogs(t)
+	r := mux.NewRouter()
+	r.Use(mwRoute)
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		// still running, and writing log data, after mwTimeout has answered
+		logDataAdd(r, "late", true)
+	}).Name("user")
+	m := &fakeMetrics{}
+	h := mwLog(mwMetrics(m)(mwTimeout(10 * time.Millisecond)(r)))
+
+	if rec := serve(h, httptest.NewRequest("GET", "/users/42", nil)); rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("got %d, want the timeout's 503", rec.Code)
+	}
+	line := logs.event(t, "request")
+	if line["route"] != "/users/{id}" || line["handler"] != "user" {
+		t.Errorf("timed out request logged with route %v, handler %v", line["route"], line["handler"])
+	}
+	if vars, _ := line["path_vars"].(map[string]string); vars["id"] != "42" {
+		t.Errorf("path_vars = %v", line["path_vars"])
+	}
+	if want := []string{"GET /users/{id} 503"}; fmt.Sprint(m.requests) != fmt.Sprint(want) {
+		t.Errorf("IncRequest calls = %q, want %q", m.requests, want)
+	}
+}
+
+func TestMwTimeoutCancelsDownstream(t *testing.T) {
+	captureLogs(t)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	}))
+	defer downstream.Close()
+
+	var callErr error
+	var took time.Duration
+	done := make(chan struct{})
+	h := mwTimeout(50 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := timeRemaining(r); !ok {
+			t.Error("the handler's context has no deadline")
+		}
+		start := time.Now()
+		req, _ := http.NewRequestWithContext(r.Context(), "GET", downstream.URL, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		callErr, took = err, time.Since(start)
+		close(done)
+	}))
+
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	// the 503 goes out at the deadline, the handler finishes on its own
+	<-done
+	if !errors.Is(callErr, context.DeadlineExceeded) {
+		t.Errorf("downstream call returned %v, want the deadline exceeded", callErr)
+	}
+	if took > time.Second {
+		t.Errorf("downstream call took %v, it should have been canceled at the deadline", took)
+	}
+}
+
+func TestHandlerDeadline(t *testing.T) {
+	start := time.Now().Add(-30 * time.Millisecond)
+	ctx, cancel := handlerDeadline(context.Background(), start, 100*time.Millisecond)
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || !deadline.Equal(start.Add(100*time.Millisecond)) {
+		t.Errorf("deadline = %v, want the budget counted from start", deadline)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	if _, ok := timeRemaining(r); ok {
+		t.Error("a request without a deadline reported time remaining")
+	}
+	if left, ok := timeRemaining(r.WithContext(ctx)); !ok || left > 70*time.Millisecond {
+		t.Errorf("timeRemaining = %v, want no more than what's left of the budget", left)
+	}
+}
+
+func TestMwLimit(t *testing.T) {
+	captureLogs(t)
+	entered, release := make(chan struct{}), make(chan struct{})
+	h := mwLimit(2)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	codes := make(chan int, 5)
+	for i := 0; i < 5; i++ {
+		go func() { codes <- serve(h, httptest.NewRequest("GET", "/", nil)).Code }()
+	}
+	<-entered
+	<-entered
+	if n := inflight.Load(); n != 2 {
+		t.Errorf("inflight = %d with two requests in the handler", n)
+	}
+	var busy int
+	for i := 0; i < 3; i++ {
+		if code := <-codes; code == http.StatusServiceUnavailable {
+			busy++
+		}
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("a request within the limit got %d", code)
+		}
+	}
+	if busy != 3 {
+		t.Errorf("%d of the requests past the limit got a 503, want 3", busy)
+	}
+	if n := inflight.Load(); n != 0 {
+		t.Errorf("inflight = %d once everything finished", n)
+	}
+}
+
+func TestReportInflightStops(t *testing.T) {
+	logs := captureLogs(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		reportInflight(ctx, time.Millisecond)
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reportInflight kept running after its context was canceled")
+	}
+	if len(logs.events("inflight")) == 0 {
+		t.Error("no inflight events were logged")
+	}
+}
+
+func TestMwRequireContentType(t *testing.T) {
+	h := mwRequireContentType("application/json", " Application/Merge-Patch+JSON")(http.HandlerFunc(anotherHandler))
+	tests := []struct {
+		method, contentType, body string
+		code                      int
+	}{
+		{"POST", "application/json", "{}", http.StatusOK},
+		{"POST", "application/json; charset=utf-8", "{}", http.StatusOK},
+		{"PATCH", "application/merge-patch+json", "{}", http.StatusOK},
+		{"PUT", "APPLICATION/JSON", "{}", http.StatusOK},
+		{"POST", "text/plain", "{}", http.StatusUnsupportedMediaType},
+		{"POST", "", "{}", http.StatusUnsupportedMediaType},
+		{"POST", "application/json;;", "{}", http.StatusUnsupportedMediaType},
+		{"POST", "text/plain", "", http.StatusOK},
+		{"DELETE", "text/plain", "{}", http.StatusOK},
+		{"GET", "text/plain", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.contentType, func(t *testing.T) {
+			logs := captureLogs(t)
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			if rec := serve(h, req); rec.Code != tt.code {
+				t.Errorf("got %d, want %d", rec.Code, tt.code)
+			}
+			if tt.code == http.StatusUnsupportedMediaType {
+				if msg := logs.event(t, "unsupported_content_type")["message"]; !strings.Contains(msg.(string), fmt.Sprintf("%q", tt.contentType)) {
+					t.Errorf("rejection doesn't log the content type: %v", msg)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+)
+
+// listenUnix listens on a unix socket at path. A socket left behind by a previous
+// run is removed first, but any other kind of file is left alone and reported.
+// Closing the listener, as Shutdown does, removes the socket file.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", path)
+}
+
+// listener pairs a server with the socket it serves, opened up front so every
+// address is known to be usable before any of them starts serving
+type listener struct {
+	srv  *http.Server
+	ln   net.Listener
+	name string
+}
+
+// serve blocks until the server stops. Servers with a TLSConfig serve HTTPS with
+// the certificates from its GetCertificate. A server stopped by Shutdown or Close
+// isn't an error.
+func (l listener) serve() error {
+	var err error
+	if l.srv.TLSConfig != nil {
+		log.Printf("starting %s on %s (tls)", l.name, l.srv.Addr)
+		err = l.srv.ServeTLS(l.ln, "", "")
+	} else {
+		log.Printf("starting %s on %s", l.name, l.srv.Addr)
+		err = l.srv.Serve(l.ln)
+	}
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return fmt.Errorf("%s: %w", l.name, err)
+}
+
+// listenTCP opens addr for srv, recording the actual address in srv.Addr so that
+// port 0 reports the port picked
+func listenTCP(name string, srv *http.Server) (listener, error) {
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		return listener{}, fmt.Errorf("unable to listen for %s: %w", name, err)
+	}
+	srv.Addr = ln.Addr().String()
+	return listener{srv: srv, ln: ln, name: name}, nil
+}
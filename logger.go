@@ -0,0 +1,380 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Logger receives every structured log line emitted by mwLog, logEvent, and logError.
+// mwLog's lines can be split off to their own Logger, see accessLogger.
+// Implementations must be safe for concurrent use.
+type Logger interface {
+	Log(fields map[string]interface{})
+}
+
+// logLevel orders log lines by severity
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = map[logLevel]string{
+	levelDebug: "debug",
+	levelInfo:  "info",
+	levelWarn:  "warn",
+	levelError: "error",
+}
+
+func (l logLevel) String() string {
+	return levelNames[l]
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for l, name := range levelNames {
+		if name == s {
+			return l, nil
+		}
+	}
+	return levelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// minLevel is the lowest level that gets logged, set by -log-level
+var minLevel = levelInfo
+
+// logVersion adds the build version to every log line, set by -log-version
+var logVersion bool
+
+// logSampleRate keeps 1 in logSampleRate requests' info and debug lines, set by
+// -log-sample-rate. 1 logs everything.
+var logSampleRate uint64 = 1
+
+// sampledOut reports whether fields should be dropped by sampling. It's decided
+// by hashing request_id, so a request's events are kept or dropped together.
+// Lines without a request ID, and those of requests that didn't get a 2xx, are
+// always kept. Kept lines of sampled requests are marked sampled.
+func sampledOut(fields map[string]interface{}) bool {
+	id, ok := fields["request_id"].(string)
+	if !ok {
+		return false
+	}
+	if code, ok := fields["code"].(int); ok && (code < 200 || code > 299) {
+		fields["sampled"] = false
+		return false
+	}
+	h := fnv.New64a()
+	h.Write([]byte(id))
+	if h.Sum64()%logSampleRate != 0 {
+		return true
+	}
+	fields["sampled"] = true
+	return false
+}
+
+// accessLogger takes mwLog's request lines instead of logger when
+// -access-log-output is set, filtered by accessMinLevel rather than minLevel
+var accessLogger Logger
+
+// accessMinLevel is the lowest level of request line logged, set by -access-log-level
+var accessMinLevel = levelInfo
+
+// logAt tags fields with level and hands them to logger, dropping them entirely
+// when level is below minLevel. Below warn, lines may also be sampled, see
+// sampledOut.
+func logAt(level logLevel, fields map[string]interface{}) {
+	emit(logger, minLevel, level, fields)
+}
+
+// logAccess is logAt for request lines, which go to accessLogger if there is one
+func logAccess(level logLevel, fields map[string]interface{}) {
+	if accessLogger == nil {
+		logAt(level, fields)
+		return
+	}
+	emit(accessLogger, accessMinLevel, level, fields)
+}
+
+func emit(l Logger, min, level logLevel, fields map[string]interface{}) {
+	if level < min {
+		return
+	}
+	if logSampleRate > 1 && level < levelWarn && sampledOut(fields) {
+		return
+	}
+	fields["level"] = level.String()
+	if logVersion {
+		fields["version"] = version
+	}
+	l.Log(fields)
+}
+
+// logger is where all structured logs go. Swap it out before serving to route logs
+// to another sink.
+var logger Logger = stdLogger{}
+
+// stdLogger writes JSON lines through the standard log package (stderr, with the
+// usual date/time prefix). This is the original skeleton behavior. Set out to
+// write through another log.Logger instead.
+type stdLogger struct {
+	out *log.Logger
+}
+
+func (l stdLogger) Log(fields map[string]interface{}) {
+	if l.out != nil {
+		l.out.Println(logAsString(fields))
+		return
+	}
+	log.Println(logAsString(fields))
+}
+
+// jsonLogger writes one bare JSON object per line to an io.Writer
+type jsonLogger struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// newJSONLogger returns a Logger writing JSON lines to w, e.g. os.Stdout
+func newJSONLogger(w io.Writer) *jsonLogger {
+	return &jsonLogger{enc: json.NewEncoder(w)}
+}
+
+func (l *jsonLogger) Log(fields map[string]interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(fields); err != nil {
+		log.Println("unable to write log line:", err)
+	}
+}
+
+// consoleLogger writes compact human readable lines for development, e.g.
+//
+//	15:04:05.000 INFO  request GET /users 200 1.204ms client_ip=::1 request_id=…
+//
+// The level, time, and the request summary come first, then the other fields
+// sorted by name.
+type consoleLogger struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newConsoleLogger(w io.Writer) *consoleLogger {
+	return &consoleLogger{w: w}
+}
+
+// consoleSummary are the fields consoleLogger prints up front, without keys
+var consoleSummary = []string{"event", "method", "url", "code"}
+
+func (l *consoleLogger) Log(fields map[string]interface{}) {
+	var b strings.Builder
+	b.WriteString(time.Now().Format("15:04:05.000"))
+	fmt.Fprintf(&b, " %-5s", strings.ToUpper(fmt.Sprint(fields["level"])))
+
+	skip := map[string]bool{"level": true, "duration_ms": true, "message": true}
+	for _, k := range consoleSummary {
+		if v, ok := fields[k]; ok {
+			fmt.Fprintf(&b, " %v", v)
+			skip[k] = true
+		}
+	}
+	if ms, ok := fields["duration_ms"].(float64); ok {
+		fmt.Fprintf(&b, " %.3fms", ms)
+	}
+	if msg, ok := fields["message"]; ok {
+		fmt.Fprintf(&b, " %q", fmt.Sprint(msg))
+	}
+
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		if !skip[k] {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := fields[k]
+		switch v.(type) {
+		case string, int, int64, float64, bool:
+		default:
+			// maps, slices and structs read better as JSON than with %v
+			if j, err := json.Marshal(v); err == nil {
+				v = string(j)
+			}
+		}
+		fmt.Fprintf(&b, " %s=%v", k, v)
+	}
+	b.WriteString("\n")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.w, b.String())
+}
+
+// asyncLogger hands log lines to a background goroutine so requests don't wait on
+// the output. When the buffer is full it either blocks or drops the line and
+// counts it, depending on block.
+type asyncLogger struct {
+	next    Logger
+	ch      chan map[string]interface{}
+	block   bool
+	dropped atomic.Int64
+	done    chan struct{}
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+// newAsyncLogger starts draining to next. Call Close to flush before exiting.
+func newAsyncLogger(next Logger, size int, block bool) *asyncLogger {
+	a := &asyncLogger{
+		next:  next,
+		ch:    make(chan map[string]interface{}, size),
+		block: block,
+		done:  make(chan struct{}),
+	}
+	go a.drain()
+	return a
+}
+
+func (a *asyncLogger) drain() {
+	defer close(a.done)
+	for fields := range a.ch {
+		a.next.Log(fields)
+	}
+}
+
+func (a *asyncLogger) Log(fields map[string]interface{}) {
+	// callers may keep mutating their map, so queue a copy
+	c := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		c[k] = v
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.closed {
+		a.next.Log(c)
+		return
+	}
+	if a.block {
+		a.ch <- c
+		return
+	}
+	select {
+	case a.ch <- c:
+	default:
+		a.dropped.Add(1)
+	}
+}
+
+// Dropped is the number of lines lost to a full buffer
+func (a *asyncLogger) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// Close writes out everything still buffered. Lines logged after Close are written
+// synchronously.
+func (a *asyncLogger) Close() {
+	a.mu.Lock()
+	if a.closed {
+		a.mu.Unlock()
+		return
+	}
+	a.closed = true
+	close(a.ch)
+	a.mu.Unlock()
+
+	<-a.done
+	if n := a.Dropped(); n > 0 {
+		a.next.Log(map[string]interface{}{
+			"event":   "log_dropped",
+			"level":   levelWarn.String(),
+			"message": fmt.Sprintf("dropped %d log lines with a full async buffer", n),
+		})
+	}
+}
+
+// fieldRename moves a standard field to name, converting its value if convert is set
+type fieldRename struct {
+	name    string
+	convert func(interface{}) interface{}
+}
+
+// fieldPresets rename the standard fields for log aggregators that expect their
+// own names, selected with -log-fields. "default" leaves everything as is.
+var fieldPresets = map[string]map[string]fieldRename{
+	"default": nil,
+	"elastic": {
+		"request_time": {name: "@timestamp", convert: unixToRFC3339},
+		"level":        {name: "log.level"},
+	},
+	"gcp": {
+		"request_time": {name: "timestamp", convert: unixToRFC3339},
+		"level":        {name: "severity", convert: gcpSeverity},
+	},
+}
+
+// renamingLogger applies a fieldPresets mapping before handing lines to next
+type renamingLogger struct {
+	next    Logger
+	renames map[string]fieldRename
+}
+
+// newRenamingLogger returns next unchanged for presets that rename nothing
+func newRenamingLogger(next Logger, preset string) (Logger, error) {
+	renames, ok := fieldPresets[preset]
+	if !ok {
+		return nil, fmt.Errorf("unknown log field preset %q", preset)
+	}
+	if len(renames) == 0 {
+		return next, nil
+	}
+	return &renamingLogger{next: next, renames: renames}, nil
+}
+
+func (l *renamingLogger) Log(fields map[string]interface{}) {
+	out := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		if rn, ok := l.renames[k]; ok {
+			if rn.convert != nil {
+				v = rn.convert(v)
+			}
+			k = rn.name
+		}
+		out[k] = v
+	}
+	l.next.Log(out)
+}
+
+// unixToRFC3339 formats seconds since the epoch, like request_time, as RFC 3339
+func unixToRFC3339(v interface{}) interface{} {
+	if sec, ok := v.(int64); ok {
+		return time.Unix(sec, 0).UTC().Format(time.RFC3339)
+	}
+	return v
+}
+
+// gcpSeverity maps level names onto Cloud Logging's severities
+func gcpSeverity(v interface{}) interface{} {
+	switch v {
+	case "debug":
+		return "DEBUG"
+	case "info":
+		return "INFO"
+	case "warn":
+		return "WARNING"
+	case "error":
+		return "ERROR"
+	}
+	return v
+}
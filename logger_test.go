@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFieldPresets(t *testing.T) {
+	tests := []struct {
+		preset, want string
+	}{
+		{"default", `{"code":200,"event":"request","level":"warn","request_time":1700000000}`},
+		{"elastic", `{"@timestamp":"2023-11-14T22:13:20Z","code":200,"event":"request","log.level":"warn"}`},
+		{"gcp", `{"code":200,"event":"request","severity":"WARNING","timestamp":"2023-11-14T22:13:20Z"}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.preset, func(t *testing.T) {
+			var buf bytes.Buffer
+			l, err := newRenamingLogger(newJSONLogger(&buf), tt.preset)
+			if err != nil {
+				t.Fatal(err)
+			}
+			fields := map[string]interface{}{"event": "request", "level": "warn", "request_time": int64(1700000000), "code": 200}
+			l.Log(fields)
+			if got := string(bytes.TrimSpace(buf.Bytes())); got != tt.want {
+				t.Errorf("got  %s\nwant %s", got, tt.want)
+			}
+			if fields["request_time"] != int64(1700000000) {
+				t.Error("renaming changed the caller's map")
+			}
+		})
+	}
+}
+
+func TestFieldPresetsUnknown(t *testing.T) {
+	if _, err := newRenamingLogger(newJSONLogger(&bytes.Buffer{}), "splunk"); err == nil {
+		t.Error("an unknown preset was accepted")
+	}
+}
+
+func TestFieldPresetsKeepRFC3339Times(t *testing.T) {
+	var buf bytes.Buffer
+	l, _ := newRenamingLogger(newJSONLogger(&buf), "elastic")
+	l.Log(map[string]interface{}{"request_time": "2023-11-14T22:13:20.5Z"})
+	if got := string(bytes.TrimSpace(buf.Bytes())); got != `{"@timestamp":"2023-11-14T22:13:20.5Z"}` {
+		t.Errorf("a request_time that's already a string was converted: %s", got)
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	newJSONLogger(&buf).Log(map[string]interface{}{"event": "request", "level": "info", "code": 200})
+	if got := buf.String(); got != "{\"code\":200,\"event\":\"request\",\"level\":\"info\"}\n" {
+		t.Errorf("got %q, want one bare JSON object per line", got)
+	}
+}
+
+func TestConsoleLogger(t *testing.T) {
+	var buf bytes.Buffer
+	newConsoleLogger(&buf).Log(map[string]interface{}{
+		"event":       "request",
+		"level":       "info",
+		"method":      "GET",
+		"url":         "/users",
+		"code":        200,
+		"duration_ms": 1.2044,
+		"request_id":  "abc",
+		"client_ip":   "::1",
+		"tags":        map[string]string{"a": "b"},
+	})
+	got := buf.String()
+	// skip the clock, "15:04:05.000"
+	if len(got) < 12 || got[2] != ':' || got[8] != '.' {
+		t.Fatalf("%q doesn't start with the time", got)
+	}
+	want := ` INFO  request GET /users 200 1.204ms client_ip=::1 request_id=abc tags={"a":"b"}` + "\n"
+	if got[12:] != want {
+		t.Errorf("got  %q\nwant %q", got[12:], want)
+	}
+}
+
+func TestConsoleLoggerMessage(t *testing.T) {
+	var buf bytes.Buffer
+	newConsoleLogger(&buf).Log(map[string]interface{}{"event": "panic", "level": "error", "message": "boom"})
+	if got := buf.String()[12:]; got != " ERROR panic \"boom\"\n" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestSamplingKeepsErrors(t *testing.T) {
+	logs := captureLogs(t)
+	saved := logSampleRate
+	logSampleRate = math.MaxUint64
+	t.Cleanup(func() { logSampleRate = saved })
+
+	for _, code := range []int{http.StatusOK, http.StatusNotFound, http.StatusInternalServerError} {
+		h := mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		}))
+		serve(h, httptest.NewRequest("GET", "/", nil))
+	}
+
+	lines := logs.events("request")
+	if len(lines) != 2 {
+		t.Fatalf("got %d request lines, want the 404 and the 500: %v", len(lines), lines)
+	}
+	for _, line := range lines {
+		if line["code"] == http.StatusOK {
+			t.Error("a 200 survived a 1 in MaxUint64 sample")
+		}
+		if line["sampled"] != false {
+			t.Errorf("%v: sampled = %v, want false", line["code"], line["sampled"])
+		}
+	}
+}
+
+func TestSampledOutByRequestID(t *testing.T) {
+	saved := logSampleRate
+	logSampleRate = 2
+	t.Cleanup(func() { logSampleRate = saved })
+
+	var kept, dropped int
+	for i := 0; i < 100; i++ {
+		id := fmt.Sprintf("req-%d", i)
+		first := map[string]interface{}{"request_id": id, "event": "request"}
+		out := sampledOut(first)
+		// the request's other events go the same way
+		if again := sampledOut(map[string]interface{}{"request_id": id, "event": "cache"}); again != out {
+			t.Fatalf("%s: events of one request were sampled differently", id)
+		}
+		if out {
+			dropped++
+			continue
+		}
+		kept++
+		if first["sampled"] != true {
+			t.Errorf("%s: kept line isn't marked sampled", id)
+		}
+	}
+	if kept == 0 || dropped == 0 {
+		t.Errorf("kept %d, dropped %d of 100 at 1 in 2", kept, dropped)
+	}
+	if sampledOut(map[string]interface{}{"event": "startup"}) {
+		t.Error("a line without a request ID was dropped")
+	}
+}
+
+func TestAccessLogSeparation(t *testing.T) {
+	app := captureLogs(t)
+	access := &testLogger{}
+	accessLogger = access
+	savedMin := accessMinLevel
+	t.Cleanup(func() { accessMinLevel = savedMin })
+
+	h := mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logEvent(r, "cache_miss", "filled")
+		logError(r, errors.New("upstream down"), "fetching")
+	}))
+	serve(h, httptest.NewRequest("GET", "/", nil))
+
+	if len(access.events("request")) != 1 || len(app.events("request")) != 0 {
+		t.Errorf("request lines: %d in the access stream, %d in the app stream", len(access.events("request")), len(app.events("request")))
+	}
+	if len(app.events("cache_miss")) != 1 || len(access.events("cache_miss")) != 0 {
+		t.Error("an application event didn't stay in the app stream")
+	}
+	if len(app.events("error")) != 1 || len(access.events("error")) != 0 {
+		t.Error("an error didn't stay in the app stream")
+	}
+
+	// the access stream has its own level
+	accessMinLevel = levelWarn
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	if len(access.events("request")) != 1 || len(app.events("cache_miss")) != 2 {
+		t.Error("-access-log-level filtered the wrong stream")
+	}
+}
+
+func TestAccessLogCombinedByDefault(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logEvent(r, "cache_miss", "filled")
+	}))
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	if len(logs.events("request")) != 1 || len(logs.events("cache_miss")) != 1 {
+		t.Errorf("without an access logger both should share logger: %v", logs.lines)
+	}
+}
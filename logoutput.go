@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// setLogOutput points the standard log package, and so stdLogger, at dest:
+// "stdout", "stderr", or a file path that's created or appended to. The returned
+// logFile is nil unless dest is a file.
+func setLogOutput(dest string) (*logFile, error) {
+	w, lf, err := openLogOutput(dest)
+	if err != nil {
+		return nil, err
+	}
+	log.SetOutput(w)
+	return lf, nil
+}
+
+// openLogOutput resolves dest the way setLogOutput does, without touching the
+// standard logger
+func openLogOutput(dest string) (io.Writer, *logFile, error) {
+	switch dest {
+	case "", "stderr":
+		return os.Stderr, nil, nil
+	case "stdout":
+		return os.Stdout, nil, nil
+	}
+	lf, err := openLogFile(dest)
+	if err != nil {
+		return nil, nil, err
+	}
+	return lf, lf, nil
+}
+
+// logFile is an append-only log file that can be reopened after logrotate moves it
+type logFile struct {
+	mu   sync.Mutex
+	path string
+	f    *os.File
+}
+
+func openLogFile(path string) (*logFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{path: path, f: f}, nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Write(p)
+}
+
+// Reopen switches to a fresh file at the same path. On failure it keeps writing
+// to the old one.
+func (l *logFile) Reopen() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	old := l.f
+	l.f = f
+	l.mu.Unlock()
+	return old.Close()
+}
+
+// Close syncs and closes the file
+func (l *logFile) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.f.Sync()
+	return l.f.Close()
+}
+
+// reopenOnHUP reopens l whenever the process gets SIGHUP, which is what logrotate's
+// postrotate scripts usually send
+func (l *logFile) reopenOnHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := l.Reopen(); err != nil {
+			log.Printf("unable to reopen log file %s: %v", l.path, err)
+		}
+	}
+}
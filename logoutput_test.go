@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAccessLogToFile(t *testing.T) {
+	app := captureLogs(t)
+	path := filepath.Join(t.TempDir(), "access.log")
+	w, lf, err := openLogOutput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lf.Close()
+	accessLogger = newJSONLogger(w)
+
+	serve(mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logEvent(r, "cache_miss", "filled")
+	})), httptest.NewRequest("GET", "/things", nil))
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(b); strings.Count(got, "\n") != 1 || !strings.Contains(got, `"event":"request"`) || !strings.Contains(got, `"url":"/things"`) {
+		t.Errorf("access log = %q, want just the request line", got)
+	}
+	if len(app.events("cache_miss")) != 1 {
+		t.Error("the application event didn't reach the app logger")
+	}
+}
+
+func TestOpenLogOutputStreams(t *testing.T) {
+	for dest, want := range map[string]*os.File{"": os.Stderr, "stderr": os.Stderr, "stdout": os.Stdout} {
+		w, lf, err := openLogOutput(dest)
+		if err != nil || w != want || lf != nil {
+			t.Errorf("%q: got %v, %v, %v", dest, w, lf, err)
+		}
+	}
+}
@@ -2,48 +2,434 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
-	"flag"
+	"errors"
 	"fmt"
+	"html/template"
+	"io"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
-	"github.com/facebookgo/flagenv"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"golang.org/x/crypto/acme/autocert"
+	"golang.org/x/sync/errgroup"
 )
 
-func init() {
-	rand.Seed(time.Now().UnixNano())
+// main exits 1 when serving fails, so supervisors see a crash rather than a clean
+// stop. Exiting after run returns lets its deferred log flushes happen first.
+func main() {
+	if err := run(); err != nil {
+		os.Exit(1)
+	}
 }
 
-func main() {
-	var port int
-	flag.IntVar(&port, "port", 9126, "port to run site")
-	flagenv.Parse()
-	flag.Parse()
+func run() error {
+	startTime = time.Now()
+	loadBuildInfo()
+	cfg, err := parseFlags()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lf, err := setLogOutput(cfg.LogOutput)
+	if err != nil {
+		log.Fatalf("invalid -log-output: %v", err)
+	}
+	if lf != nil {
+		// registered before the async logger's Close so that flushes into the file first
+		defer lf.Close()
+		go lf.reopenOnHUP()
+	}
+
+	if cfg.LogFormat == "console" {
+		logger = newConsoleLogger(log.Writer())
+	}
+	if logger, err = newRenamingLogger(logger, cfg.LogFields); err != nil {
+		log.Fatalf("invalid -log-fields: %v", err)
+	}
+
+	build := buildInfo()
+	build["event"] = "build"
+	logAt(levelInfo, build)
+
+	if cfg.PrintConfig {
+		logAt(levelInfo, map[string]interface{}{"event": "config", "config": cfg.values()})
+	}
+
+	if cfg.AccessLogOutput != "" {
+		w, alf, err := openLogOutput(cfg.AccessLogOutput)
+		if err != nil {
+			log.Fatalf("invalid -access-log-output: %v", err)
+		}
+		if alf != nil {
+			defer alf.Close()
+			go alf.reopenOnHUP()
+		}
+		format := cfg.AccessLogFormat
+		if format == "" {
+			format = cfg.LogFormat
+		}
+		if format == "console" {
+			accessLogger = newConsoleLogger(w)
+		} else {
+			accessLogger = stdLogger{out: log.New(w, "", log.LstdFlags)}
+		}
+		// -log-fields was already checked for logger
+		accessLogger, _ = newRenamingLogger(accessLogger, cfg.LogFields)
+	}
+
+	if cfg.LogAsync {
+		al := newAsyncLogger(logger, cfg.LogAsyncBuffer, cfg.LogAsyncBlock)
+		logger = al
+		// runs after shutdown has drained requests so their lines make it out
+		defer al.Close()
+		if accessLogger != nil {
+			aal := newAsyncLogger(accessLogger, cfg.LogAsyncBuffer, cfg.LogAsyncBlock)
+			accessLogger = aal
+			defer aal.Close()
+		}
+	}
+
+	logHeaders = cfg.LogHeaders
+	maxBodyBytes = cfg.MaxBodyBytes
+	logTTS = cfg.LogTTS
+	logVersion = cfg.LogVersion
+	logSampleRate = uint64(cfg.LogSampleRate)
+	logTimeFormat = cfg.LogTime
+	slowThreshold = cfg.SlowThreshold
+	addRedactions(redactedHeaders, cfg.RedactHeaders, true)
+	addRedactions(redactedParams, cfg.RedactParams, false)
+	addRedactions(redactedHeaders, cfg.APIKeyHeader, true)
+	addRedactions(redactedParams, cfg.APIKeyParam, false)
+
+	if minLevel, err = parseLogLevel(cfg.LogLevel); err != nil {
+		log.Fatalf("invalid -log-level: %v", err)
+	}
+	accessMinLevel = minLevel
+	if cfg.AccessLogLevel != "" {
+		if accessMinLevel, err = parseLogLevel(cfg.AccessLogLevel); err != nil {
+			log.Fatalf("invalid -access-log-level: %v", err)
+		}
+	}
+	if trustedProxies, err = parseCIDRs(cfg.TrustedProxies); err != nil {
+		log.Fatalf("invalid -trusted-proxies: %v", err)
+	}
+	if authUsers, err = parseAuthUsers(cfg.AuthUsers); err != nil {
+		log.Fatalf("invalid -auth-users: %v", err)
+	}
+	if len(authUsers) == 0 {
+		log.Println("no -auth-users set, authenticated routes will reject every request")
+	}
+
+	r, err := newRouter(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// outermost first; see mwStage for why they go in this order
+	var mws chainBuilder
+	mws.add(stagePanic, mwPanic)
+	mws.add(stageRequestID, mwRequestID)
+	mws.add(stageHealth, mwHealth(cfg.HealthPath, cfg.ReadyPath))
+	mws.add(stageLog, mwLog)
+	mws.add(stageLog, mwTrace(tracerProvider))
+	if cfg.ProxyHeaders {
+		mws.add(stageGuard, mwProxyHeaders)
+	}
+	if cfg.AllowedHosts != "" {
+		mws.add(stageGuard, mwAllowedHosts(strings.Split(cfg.AllowedHosts, ",")...))
+	}
+	if cfg.RequireHTTPS != "" {
+		mws.add(stageGuard, mwRequireHTTPS(cfg.RequireHTTPS == "redirect", cfg.HTTPSHost))
+	}
+	if cfg.NormalizePath != "" {
+		mws.add(stageGuard, mwNormalizePath(cfg.NormalizePath == "redirect"))
+	}
+	if cfg.CleanPath {
+		var skip []string
+		if cfg.StaticDir != "" {
+			skip = append(skip, cfg.StaticPrefix)
+		}
+		mws.add(stageGuard, mwCleanPath(skip...))
+	}
+	if cfg.MetricsPath != "" {
+		r.Handle(cfg.MetricsPath, promhttp.Handler()).Name("metrics")
+		mws.add(stageMetrics, mwMetrics(newMetrics(prometheus.DefaultRegisterer)))
+	}
+	if cfg.Maintenance {
+		setMaintenance(nil, true)
+	}
+	mws.add(stageLimit, mwMaintenance(cfg.MaintenanceRetryAfter,
+		maintenancePath, cfg.StatusPath, cfg.MetricsPath, cfg.HealthPath, cfg.ReadyPath))
+	if cfg.ClientCA != "" {
+		mws.add(stageLimit, mwClientCert)
+	}
+	if cfg.RateLimit > 0 {
+		mws.add(stageLimit, mwRateLimit(cfg.RateLimit, cfg.RateBurst))
+	}
+	mws.add(stageLimit, mwLimit(cfg.MaxInflight))
+	if cfg.HandlerTimeout > 0 {
+		mws.add(stageTimeout, mwTimeout(cfg.HandlerTimeout))
+	}
+	if cfg.SecurityHeaders {
+		mws.add(stageResponse, mwSecurityHeaders(defaultSecurityHeaders))
+	}
+	if cfg.ETag {
+		mws.add(stageResponse, mwETag)
+	}
+	if cfg.Gzip {
+		mws.add(stageResponse, mwGzip)
+	}
+	if cfg.CORSOrigins != "" {
+		mws.add(stageResponse, mwCORS(strings.Split(cfg.CORSOrigins, ",")))
+	}
+	if cfg.CSRF {
+		keys, err := parseAPIKeys(cfg.APIKeys)
+		if err != nil {
+			log.Fatalf("invalid -api-keys: %v", err)
+		}
+		mws.add(stageRequest, mwCSRF(cfg.CSRFCookie, cfg.CSRFHeader, keys, cfg.APIKeyHeader))
+	}
+	if cfg.MaxHeaderBytes > 0 {
+		mws.add(stageRequest, mwMaxHeaderBytes(cfg.MaxHeaderBytes))
+	}
+	if cfg.ContentTypes != "" {
+		mws.add(stageRequest, mwRequireContentType(strings.Split(cfg.ContentTypes, ",")...))
+	}
+	if cfg.MaxBodyBytes > 0 {
+		mws.add(stageRequest, mwMaxBody(cfg.MaxBodyBytes))
+	}
+	if cfg.IdempotencyTTL > 0 {
+		mws.add(stageRequest, mwIdempotency(newMemoryIdempotencyStore(), cfg.IdempotencyTTL, cfg.APIKeyHeader, cfg.APIKeyParam))
+	}
+	if cfg.DebugCapture > 0 {
+		log.Printf("capturing up to %d bytes of request and response bodies in the logs", cfg.DebugCapture)
+		mws.add(stageRequest, mwCapture(cfg.DebugCapture))
+	}
+	if cfg.MethodOverride {
+		mws.add(stageRequest, mwMethodOverride)
+	}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/", indexHandler)
-	r.HandleFunc("/unauth", somethingHandler)
-	r.Handle("/auth", mwAuth(http.HandlerFunc(anotherHandler)))
+	handler := mws.handler(r)
+	srv := newServer(cfg, handler)
+	srv.Addr = cfg.Addr
 
-	http.Handle("/", mwPanic(mwLog(r)))
+	if cfg.TLSCert != "" {
+		certs, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			log.Fatalf("invalid -tls-cert or -tls-key: %v", err)
+		}
+		go certs.reloadOnHUP()
+		srv.TLSConfig = newTLSConfig()
+		srv.TLSConfig.GetCertificate = certs.GetCertificate
+		if cfg.ClientCA != "" {
+			if err := requireClientCerts(srv.TLSConfig, cfg.ClientCA); err != nil {
+				log.Fatalf("invalid -client-ca: %v", err)
+			}
+		}
+	}
 
-	log.Printf("starting on :%d", port)
+	var acmeManager *autocert.Manager
+	if cfg.ACMEDomains != "" {
+		m, err := newACMEManager(cfg.ACMEDomains, cfg.ACMECacheDir)
+		if err != nil {
+			log.Fatalf("invalid -acme-cache-dir: %v", err)
+		}
+		acmeManager = m
+		srv.TLSConfig = newTLSConfig()
+		srv.TLSConfig.GetCertificate = m.GetCertificate
+	}
 
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", port), nil); err != nil {
-		log.Println("Unexpected error serving: ", err.Error())
+	// everything above fails fast with log.Fatal, so getting here means it's usable
+	if cfg.CheckConfig {
+		log.Println("config ok")
+		// returning, not exiting, so the deferred log flushes still run
+		return nil
 	}
+
+	var listeners []listener
+	if cfg.UnixSocket != "" {
+		ln, err := listenUnix(cfg.UnixSocket)
+		if err != nil {
+			log.Fatalf("unable to listen: %v", err)
+		}
+		srv.Addr = ln.Addr().String()
+		listeners = append(listeners, listener{srv: srv, ln: ln, name: "server"})
+	} else {
+		l, err := listenTCP("server", srv)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	// plain HTTP next to the TLS listener, e.g. on :80 while -addr is :443
+	if cfg.HTTPAddr != "" {
+		plain := newServer(cfg, handler)
+		plain.Addr = cfg.HTTPAddr
+		if cfg.HTTPSRedirect {
+			plain.Handler = mwHTTPSRedirect(cfg.HTTPSHost)(handler)
+		}
+		if acmeManager != nil {
+			// answers challenges itself and hands everything else to plain.Handler
+			plain.Handler = acmeManager.HTTPHandler(plain.Handler)
+		}
+		l, err := listenTCP("http server", plain)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	// never on the main server, so profiling and vars can't be reached publicly
+	if cfg.DebugAddr != "" {
+		l, err := listenTCP("debug server", newDebugServer(cfg.DebugAddr))
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	srvs := make([]*http.Server, len(listeners))
+	for i, l := range listeners {
+		srvs[i] = l.srv
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+
+	// if any server fails, ctx is canceled and the rest are shut down with it
+	setReady(true)
+	g, ctx := errgroup.WithContext(context.Background())
+	for _, l := range listeners {
+		g.Go(func() error {
+			return l.serve()
+		})
+	}
+	// canceled once shutdown starts, stopping the background reporting with it
+	draining, drain := context.WithCancel(ctx)
+	g.Go(func() error {
+		select {
+		case <-ctx.Done():
+		case sig := <-stop:
+			log.Printf("received %s, shutting down", sig)
+		}
+		drain()
+		shutdown(cfg.ShutdownDelay, cfg.ShutdownTimeout, srvs...)
+		return nil
+	})
+	// the count only means something to someone limiting or graphing it
+	if cfg.MaxInflight > 0 || cfg.MetricsPath != "" {
+		g.Go(func() error {
+			reportInflight(draining, time.Minute)
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		logEventLevel(nil, levelError, "serve_failed", err.Error())
+		return err
+	}
+	return nil
+}
+
+// newServer returns a server for handler with the timeouts and limits from cfg.
+//
+// The timeouts bound slow clients (Slowloris and friends). The write timeout
+// covers the whole response, so it cuts off streaming handlers (SSE, long
+// downloads) that run past it; set -write-timeout 0 when serving those and rely
+// on -handler-timeout for ordinary routes.
+//
+// With keep-alives disabled every response carries Connection: close (net/http
+// adds it) and each request pays for a new connection, and a TLS handshake too.
+// That's worth it behind load balancers that pool their own connections, or to
+// have clients spread over new instances quickly during a rollout.
+func newServer(cfg Config, handler http.Handler) *http.Server {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+		ConnState:         trackConn,
+	}
+	if cfg.DisableKeepAlive {
+		srv.SetKeepAlivesEnabled(false)
+	}
+	return srv
+}
+
+// validateAddr checks that addr is a host:port with a numeric port
+func validateAddr(addr string) error {
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if n, err := strconv.Atoi(p); err != nil || n < 0 || n > 65535 {
+		return fmt.Errorf("port %q is not a number between 0 and 65535", p)
+	}
+	return nil
+}
+
+// shutdown stops accepting new connections and waits up to timeout for in-flight
+// requests to finish. If they don't, the remaining connections are closed forcibly.
+//
+// The readiness probe starts failing first, then shutdown waits delay before
+// draining. Set delay to at least the load balancer's probe interval times its
+// failure threshold so it stops routing here while the listener is still open;
+// otherwise new requests may be refused while the LB still thinks we're up.
+//
+// All of srvs share the one timeout, and so do the onShutdown hooks run after them.
+// While draining, the count of connections still open is logged every second.
+func shutdown(delay, timeout time.Duration, srvs ...*http.Server) {
+	setReady(false)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	done := make(chan struct{})
+	go reportDraining(done, time.Second)
+
+	start := time.Now()
+	forced := false
+	for _, srv := range srvs {
+		if err := srv.Shutdown(ctx); err != nil {
+			logEventLevel(nil, levelWarn, "shutdown_forced", fmt.Sprintf("in-flight requests on %s did not drain within %s: %v", srv.Addr, timeout, err))
+			srv.Close()
+			forced = true
+		}
+	}
+	close(done)
+	runShutdownHooks(ctx)
+
+	logAt(levelInfo, map[string]interface{}{
+		"event":       "shutdown_complete",
+		"message":     fmt.Sprintf("drained in %s", time.Since(start).Round(time.Millisecond)),
+		"forced":      forced,
+		"connections": openConns.Load(),
+	})
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("index handler")
+	writeJSON(w, r, http.StatusOK, map[string]string{"status": "ok"})
 }
 
 func somethingHandler(w http.ResponseWriter, r *http.Request) {
@@ -54,115 +440,482 @@ func anotherHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println("handle auth")
 }
 
-func mwAuth(h http.Handler) http.Handler {
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusNotFound, map[string]string{"error": "not found"})
+}
+
+// methodNotAllowedHandler responds with a 405 and an Allow header listing the
+// methods the router would have accepted for the path
+func methodNotAllowedHandler(router *mux.Router) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Println("requires auth", r.URL)
-		h.ServeHTTP(w, r)
+		var allowed []string
+		for _, method := range []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions} {
+			req := r.Clone(r.Context())
+			req.Method = method
+			var match mux.RouteMatch
+			if router.Match(req, &match) && match.MatchErr == nil {
+				allowed = append(allowed, method)
+			}
+		}
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		writeJSON(w, r, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
 	})
 }
 
+// middleware wraps a handler with extra behavior
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h with mws. The first middleware listed is the outermost: it sees the
+// request first and the response last, so chain(h, a, b) is a(b(h)).
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		h = mws[i](h)
+	}
+	return h
+}
+
+// mwStage is where a middleware belongs in the server wide chain, outermost first.
+// The order matters for what gets observed:
+//
+//   - panic recovery first, so a panic anywhere, mwLog included, is a 500
+//   - request ID next; it fills in the log map mwPanic shares with it, so the
+//     panic event still carries the request_id
+//   - health probes answered before mwLog, so they don't flood the logs
+//   - mwLog and tracing outside everything that can reject or time out a request,
+//     or those responses would go unlogged
+//   - host, scheme, and path checks before metrics, so turned away junk doesn't
+//     show up as routes
+//   - metrics outside the limits and the timeout, so 429s and 503s are counted
+//   - mwTimeout outside the response wrappers and request checks, so the deadline
+//     covers them too
+//   - response wrappers (headers, etag, gzip, cors) outside the request checks,
+//     so rejections get the same headers as everything else
+type mwStage int
+
+const (
+	stagePanic mwStage = iota
+	stageRequestID
+	stageHealth
+	stageLog
+	stageGuard
+	stageMetrics
+	stageLimit
+	stageTimeout
+	stageResponse
+	stageRequest
+)
+
+var mwStageNames = map[mwStage]string{
+	stagePanic:     "panic",
+	stageRequestID: "request id",
+	stageHealth:    "health",
+	stageLog:       "log",
+	stageGuard:     "guard",
+	stageMetrics:   "metrics",
+	stageLimit:     "limit",
+	stageTimeout:   "timeout",
+	stageResponse:  "response",
+	stageRequest:   "request",
+}
+
+func (s mwStage) String() string {
+	return mwStageNames[s]
+}
+
+// chainBuilder collects the server wide middleware, refusing to add one to a
+// stage before the last one added. A misordered chain is a programming error
+// that silently loses logs or metrics, so it panics at startup instead.
+type chainBuilder struct {
+	mws  []middleware
+	last mwStage
+}
+
+// add appends mw at stage, inside everything added so far
+func (b *chainBuilder) add(stage mwStage, mw middleware) {
+	if stage < b.last {
+		panic(fmt.Sprintf("middleware for the %s stage added after the %s stage", stage, b.last))
+	}
+	b.last = stage
+	b.mws = append(b.mws, mw)
+}
+
+// handler wraps h in the middleware added, see chain. Without a log stage nothing
+// is logged per request, which is worth a warning.
+func (b *chainBuilder) handler(h http.Handler) http.Handler {
+	if b.last < stageLog {
+		log.Println("middleware chain has no log stage, requests won't be logged")
+	}
+	return chain(h, b.mws...)
+}
+
+// panicOptions controls the response mwPanicWith writes after recovering a panic.
+// The body must never include the panic value or stack; those only go to the logs.
+type panicOptions struct {
+	code        int
+	contentType string
+	body        func(r *http.Request) []byte
+	// html, when set, is sent instead of body to clients preferring HTML (see
+	// prefersHTML), as text/html
+	html func(r *http.Request) []byte
+	// hook reports the panic, e.g. to an error tracker, before the response is
+	// written. A panicking hook is recovered and logged.
+	hook panicHook
+}
+
+// panicHook receives a recovered panic value and the stack it was raised from
+type panicHook func(r *http.Request, recovered interface{}, stack []byte)
+
+// logPanic is the default panicHook. The stack is logged as frames (see
+// parseStack) so it can be queried.
+func logPanic(r *http.Request, recovered interface{}, stack []byte) {
+	logData := logDataCopy(r)
+	logData["event"] = "panic"
+	logData["message"] = fmt.Sprintf("panic: %v", recovered)
+	logData["panic_value"] = fmt.Sprintf("%v", recovered)
+	logData["stack"] = parseStack(stack, panicMaxFrames)
+	logAt(levelError, logData)
+}
+
+// runPanicHook calls hook, making sure a broken hook can't take down the server
+func runPanicHook(hook panicHook, r *http.Request, recovered interface{}, stack []byte) {
+	defer func() {
+		if rec := recover(); rec != nil {
+			logEventLevel(r, levelError, "panic_hook_failed", fmt.Sprintf("%v", rec))
+		}
+	}()
+	hook(r, recovered, stack)
+}
+
+var defaultPanicOptions = panicOptions{
+	code:        http.StatusInternalServerError,
+	contentType: "application/json",
+	body: func(r *http.Request) []byte {
+		requestID, _ := logDataGet(r)["request_id"].(string)
+		b, _ := json.Marshal(map[string]string{"error": "internal server error", "request_id": requestID})
+		return b
+	},
+	html: func(r *http.Request) []byte {
+		requestID, _ := logDataGet(r)["request_id"].(string)
+		var buf bytes.Buffer
+		panicPage.Execute(&buf, requestID)
+		return buf.Bytes()
+	},
+	hook: logPanic,
+}
+
+// panicPage is the default HTML error page, given the request ID
+var panicPage = template.Must(template.New("panic").Parse(`<!DOCTYPE html>
+<html>
+<head><title>500 Internal Server Error</title></head>
+<body>
+<h1>Internal Server Error</h1>
+<p>Something went wrong on our end. If you report it, please include request ID <code>{{.}}</code>.</p>
+</body>
+</html>
+`))
+
 func mwPanic(h http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			if rec := recover(); rec != nil {
-				logEvent(r, "panic", fmt.Sprintf("%v %s", rec, debug.Stack()))
+	return mwPanicWith(defaultPanicOptions)(h)
+}
+
+// mwPanicWith recovers panics, logs them, and responds with opts if nothing has
+// been written to the client yet
+func mwPanicWith(opts panicOptions) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// share one log map with mwRequestID and mwLog so the panic event carries the request_id
+			r, data, owned := logDataEnsure(r)
+			if owned {
+				defer logDataRelease(data)
 			}
-		}()
-		h.ServeHTTP(w, r)
-	})
+
+			lw := newLogWriter(w, r)
+			defer writers.Put(lw)
+
+			defer func() {
+				if rec := recover(); rec != nil {
+					// ErrAbortHandler is how a handler asks the server to drop the
+					// connection without logging a stack, so hand it back
+					if rec == http.ErrAbortHandler {
+						panic(rec)
+					}
+					// a write to a client that hung up isn't a bug, and there's no one to respond to
+					if err, ok := rec.(error); ok && clientGone(r, err) {
+						logEventLevel(r, levelInfo, "client_disconnect", err.Error())
+						return
+					}
+					if opts.hook != nil {
+						runPanicHook(opts.hook, r, rec, debug.Stack())
+					}
+					if !lw.headerWritten {
+						contentType, body := opts.contentType, opts.body
+						if opts.html != nil && prefersHTML(r) {
+							contentType, body = "text/html; charset=utf-8", opts.html
+						}
+						lw.Header().Set("Content-Type", contentType)
+						lw.WriteHeader(opts.code)
+						lw.Write(body(r))
+					}
+				}
+			}()
+			h.ServeHTTP(lw, r)
+		})
+	}
+}
+
+// clientGone reports whether err comes from the client going away mid-request,
+// rather than from something wrong on our end
+func clientGone(r *http.Request, err error) bool {
+	if errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET) || errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	return r != nil && errors.Is(r.Context().Err(), context.Canceled)
 }
 
 func logDataGet(r *http.Request) map[string]interface{} {
-	ctx := r.Context()
-	data := ctx.Value("log")
-	switch v := data.(type) {
-	case map[string]interface{}:
-		return v
+	if r == nil {
+		return make(map[string]interface{})
+	}
+	if data, ok := logDataFrom(r.Context()); ok {
+		return data
 	}
 	return make(map[string]interface{})
 }
 
-func logDataAdd(r *http.Request, key string, value interface{}) {
-	var data map[string]interface{}
+// logDataCopy returns a copy of the request's log data, for events that shouldn't
+// change the fields of the request log line
+func logDataCopy(r *http.Request) map[string]interface{} {
+	data := make(map[string]interface{})
+	for k, v := range logDataGet(r) {
+		data[k] = v
+	}
+	return data
+}
 
-	ctx := r.Context()
-	d := ctx.Value("log")
-	switch v := d.(type) {
-	case map[string]interface{}:
-		data = v
-	default:
-		data = make(map[string]interface{})
+// logDataAdd sets key on the request's log data. mwLog stores a mutable map in the
+// context, so handlers behind it can ignore the returned request; outside of mwLog,
+// the returned request is the only one carrying the new field.
+func logDataAdd(r *http.Request, key string, value interface{}) *http.Request {
+	if data, ok := logDataFrom(r.Context()); ok {
+		data[key] = value
+		return r
 	}
+	return logDataReplace(r, map[string]interface{}{key: value})
+}
+
+// logMaps recycles the per-request log maps, mirroring the writers pool
+var logMaps = sync.Pool{
+	New: func() interface{} {
+		return make(map[string]interface{})
+	},
+}
 
-	data[key] = value
+// logDataEnsure returns r carrying a log map, the map, and whether it was newly
+// pulled from the pool. Whoever gets owned == true must logDataRelease the map once
+// the request is done. Loggers must not hold on to the map after Log returns.
+func logDataEnsure(r *http.Request) (*http.Request, map[string]interface{}, bool) {
+	if data, ok := logDataFrom(r.Context()); ok {
+		return r, data, false
+	}
+	data := logMaps.Get().(map[string]interface{})
+	return logDataReplace(r, data), data, true
+}
+
+// logDataRelease clears data so nothing leaks into the next request and returns
+// it to the pool
+func logDataRelease(data map[string]interface{}) {
+	clear(data)
+	logMaps.Put(data)
+}
 
-	r = r.WithContext(context.WithValue(ctx, "log", data))
+// logDataReplace returns a copy of r whose log data is data
+func logDataReplace(r *http.Request, data map[string]interface{}) *http.Request {
+	return r.WithContext(withLogData(r.Context(), data))
 }
 
-func logDataReplace(r *http.Request, data map[string]interface{}) {
-	ctx := r.Context()
-	r = r.WithContext(context.WithValue(ctx, "log", data))
+// logTTS keeps the legacy tts_ns field in request log lines, set by -log-tts
+var logTTS bool
+
+// logTimeFormat is how request_time is logged, set by -log-time: "unix" for
+// whole seconds since the epoch, "rfc3339" for an RFC 3339 string with
+// nanoseconds, or "both" for the unix field plus request_timestamp
+var logTimeFormat = "unix"
+
+func addRequestTime(logData map[string]interface{}, start time.Time) {
+	switch logTimeFormat {
+	case "rfc3339":
+		logData["request_time"] = start.UTC().Format(time.RFC3339Nano)
+	case "both":
+		logData["request_time"] = start.Unix()
+		logData["request_timestamp"] = start.UTC().Format(time.RFC3339Nano)
+	default:
+		logData["request_time"] = start.Unix()
+	}
 }
 
-var ranOnce bool
+// slowThreshold marks slower requests as slow and logs them at warn, set by
+// -slow-threshold. Zero turns it off.
+var slowThreshold time.Duration
 
 func mwLog(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
-		logData := logDataGet(r)
-		logData["request_time"] = start.Unix()
-		logData["request_id"] = fmt.Sprintf("%08x", rand.Int63n(1e9))
+		// store the map in the context so handlers can enrich it in place with logDataAdd
+		r, logData, owned := logDataEnsure(r)
+		if owned {
+			defer logDataRelease(logData)
+		}
+		addRequestTime(logData, start)
+		w.Header().Set("X-Request-ID", assignRequestID(r, logData))
 		logData["event"] = "request"
 		logData["remote_addr"] = r.RemoteAddr
+		logData["client_ip"] = clientIP(r)
 		logData["method"] = r.Method
-		logData["url"] = r.URL.String()
+		logData["url"] = redactURL(r.URL)
+		if logHeaders {
+			logData["headers"] = redactHeaders(r.Header)
+		}
 		logData["content_length"] = r.ContentLength
 
 		// init the logger's response writer used to caputure the status code
-		// pull from a pool, set the writer, initialize / reset the response code to a sensible default, reset that this response writer has been used
 		// for the logging middleware (based on noodle's logger middleware)
-		// could put the ranOnce in the init, but I want to make copy-pasta easier if I use mwLog again (before turning it into a real package)
-		if !ranOnce {
-			ranOnce = true
-			writers.New = func() interface{} {
-				return &logWriter{}
-			}
-		}
-		lw := writers.Get().(*logWriter)
-		lw.ResponseWriter = w
-		lw.code = http.StatusOK
-		lw.headerWritten = false
+		lw := newLogWriter(w, r)
 		defer writers.Put(lw)
 
-		h.ServeHTTP(lw, r)
+		// deferred so a panicking request still gets its line, with the same
+		// request_id as the panic event, before mwPanic takes over
+		defer func() {
+			rec := recover()
+			logData["code"] = lw.Code()
+			if rec != nil {
+				logData["panic"] = true
+				if !lw.headerWritten {
+					logData["code"] = http.StatusInternalServerError
+				}
+			}
+			logData["response_bytes"] = lw.Bytes()
+			// usually the client going away; mwTimeout's deadline is on a child
+			// context and shows up as timed_out instead
+			if err := r.Context().Err(); err != nil {
+				logData["canceled"] = true
+				logData["context_error"] = err.Error()
+			}
+			elapsed := time.Since(start)
+			logData["duration_ms"] = float64(elapsed) / float64(time.Millisecond)
+			logData["duration_ns"] = elapsed.Nanoseconds()
+			if logTTS {
+				// the old field, which despite the name is whole milliseconds
+				logData["tts_ns"] = elapsed.Milliseconds()
+			}
 
-		logData["code"] = lw.Code()
-		logData["tts_ns"] = time.Since(start).Nanoseconds() / 1e6 // time to serve in nano seconds
+			level := levelInfo
+			if slowThreshold > 0 && elapsed > slowThreshold {
+				level = levelWarn
+				logData["slow"] = true
+			}
+			logAccess(level, logData)
+			if rec != nil {
+				panic(rec)
+			}
+		}()
 
-		log.Println(logAsString(logData))
+		h.ServeHTTP(lw, r)
 	})
 }
 
+// mwRequestID assigns the request ID before anything else runs, so the events of
+// outer middleware like mwPanic carry the same request_id as the request line.
+// mwLog assigns one itself when used without this.
+func mwRequestID(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, logData, owned := logDataEnsure(r)
+		if owned {
+			defer logDataRelease(logData)
+		}
+		w.Header().Set("X-Request-ID", assignRequestID(r, logData))
+		h.ServeHTTP(w, r)
+	})
+}
+
+// assignRequestID returns the request_id already in logData, or else stores one:
+// the client's X-Request-ID when it's valid, otherwise a new one
+func assignRequestID(r *http.Request, logData map[string]interface{}) string {
+	if id, ok := logData["request_id"].(string); ok {
+		return id
+	}
+	id := r.Header.Get("X-Request-ID")
+	if !validRequestID(id) {
+		id = newRequestID()
+	}
+	logData["request_id"] = id
+	return id
+}
+
+// newRequestID returns 16 random hex characters. It's a variable so tests and
+// embedders can swap in their own scheme.
+var newRequestID = func() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// validRequestID accepts upstream request IDs that are short and made of URL safe
+// characters, so they can't be used to inject junk into logs or headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// logBuffers recycles the buffers log lines are encoded into
+var logBuffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
 func logAsString(l map[string]interface{}) string {
-	b, err := json.Marshal(l)
-	if err != nil {
+	buf := logBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer logBuffers.Put(buf)
+
+	if err := json.NewEncoder(buf).Encode(l); err != nil {
 		logError(nil, err, "unable to marshal map[string]interface{}")
 	}
-	return string(b)
+	return string(bytes.TrimSuffix(buf.Bytes(), []byte("\n")))
 }
 
-// logEvent allows us to track novel happeningsf
+// logEvent allows us to track novel happenings
 func logEvent(r *http.Request, event string, msg string) {
-	logData := logDataGet(r)
+	logEventLevel(r, levelInfo, event, msg)
+}
+
+// logEventLevel is logEvent for events that deserve a level other than info
+func logEventLevel(r *http.Request, level logLevel, event string, msg string) {
+	logData := logDataCopy(r)
 	logData["event"] = event
 	logData["message"] = msg
 
-	log.Println(logAsString(logData))
+	logAt(level, logData)
+}
+
+// logDebug is for verbose tracing and is dropped unless -log-level is debug
+func logDebug(r *http.Request, msg string) {
+	logEventLevel(r, levelDebug, "debug", msg)
 }
 
 // logError is similar to logEvent but has an error field
 func logError(r *http.Request, err error, msg string) {
-	logData := logDataGet(r)
+	logData := logDataCopy(r)
 	logData["event"] = "error"
 	logData["message"] = msg
 	if err == nil {
@@ -170,7 +923,7 @@ func logError(r *http.Request, err error, msg string) {
 	}
 	logData["error"] = err.Error()
 
-	log.Println(logAsString(logData))
+	logAt(levelError, logData)
 }
 
 // everything below is for the logger mw (from noodle)
@@ -179,31 +932,88 @@ func logError(r *http.Request, err error, msg string) {
 // HTTP status code for later logging
 type logWriter struct {
 	code          int
+	bytes         int
 	headerWritten bool
+	r             *http.Request // only for logging
 	http.ResponseWriter
 }
 
+// newLogWriter pulls a logWriter from the pool, sets the writer, and resets the
+// response code to a sensible default, the byte count, and that nothing has been written.
+// Callers should hand it back with writers.Put when the request is done.
+func newLogWriter(w http.ResponseWriter, r *http.Request) *logWriter {
+	lw := writers.Get().(*logWriter)
+	lw.ResponseWriter = w
+	lw.r = r
+	lw.code = http.StatusOK
+	lw.bytes = 0
+	lw.headerWritten = false
+	return lw
+}
+
+// WriteHeader passes the first status through and ignores later ones, which
+// net/http would only complain about. Calling it after Write is ignored the same
+// way since the implicit 200 is already out. 1xx informational statuses other
+// than 101 aren't final and are passed through without counting.
 func (l *logWriter) WriteHeader(code int) {
-	l.headerWritten = false
-	if !l.headerWritten {
-		l.ResponseWriter.WriteHeader(code)
-		l.code = code
-		l.headerWritten = true
+	if l.headerWritten {
+		logEventLevel(l.r, levelWarn, "superfluous_write_header", fmt.Sprintf("ignored WriteHeader(%d), already sent %d", code, l.code))
+		return
+	}
+	l.ResponseWriter.WriteHeader(code)
+	if code >= 100 && code < 200 && code != http.StatusSwitchingProtocols {
+		return
 	}
+	l.code = code
+	l.headerWritten = true
 }
 
 func (l *logWriter) Write(buf []byte) (int, error) {
 	l.headerWritten = true
-	return l.ResponseWriter.Write(buf)
+	n, err := l.ResponseWriter.Write(buf)
+	l.bytes += n
+	return n, err
+}
+
+// ReadFrom lets http.FileServer reach the connection's sendfile path through the
+// wrapper instead of copying the file through Write
+func (l *logWriter) ReadFrom(src io.Reader) (int64, error) {
+	l.headerWritten = true
+	var n int64
+	var err error
+	if rf, ok := l.ResponseWriter.(io.ReaderFrom); ok {
+		n, err = rf.ReadFrom(src)
+	} else {
+		n, err = io.Copy(l.ResponseWriter, src)
+	}
+	l.bytes += int(n)
+	return n, err
 }
 
 func (l *logWriter) Code() int {
 	return l.code
 }
 
+// Bytes is the number of body bytes written to the client
+func (l *logWriter) Bytes() int {
+	return l.bytes
+}
+
 // provide other typical ResponseWriter methods
+
+// Hijack hands the connection to the handler, and with it the response: nothing
+// written to the conn is counted in the code or byte totals. When a protocol
+// upgrade such as a WebSocket hijacks before writing a status itself, the
+// request is logged as 101 Switching Protocols.
 func (l *logWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
-	return l.ResponseWriter.(http.Hijacker).Hijack()
+	conn, rw, err := l.ResponseWriter.(http.Hijacker).Hijack()
+	if err == nil && !l.headerWritten {
+		l.headerWritten = true
+		if l.r != nil && l.r.Header.Get("Upgrade") != "" {
+			l.code = http.StatusSwitchingProtocols
+		}
+	}
+	return conn, rw, err
 }
 
 func (l *logWriter) CloseNotify() <-chan bool {
@@ -214,4 +1024,17 @@ func (l *logWriter) Flush() {
 	l.ResponseWriter.(http.Flusher).Flush()
 }
 
-var writers sync.Pool
+// Push keeps HTTP/2 server push working through the wrapper
+func (l *logWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := l.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// writers is set up at declaration so concurrent first requests don't race on New
+var writers = sync.Pool{
+	New: func() interface{} {
+		return &logWriter{}
+	},
+}
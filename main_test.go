@@ -0,0 +1,768 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// serve runs req through h and returns what it wrote
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+// testLogger keeps copies of the lines logged, since the maps handed to Log are
+// pooled and cleared once the request is done
+type testLogger struct {
+	mu    sync.Mutex
+	lines []map[string]interface{}
+}
+
+func (l *testLogger) Log(fields map[string]interface{}) {
+	line := make(map[string]interface{}, len(fields))
+	for k, v := range fields {
+		line[k] = v
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, line)
+}
+
+// events returns the lines logged with the given event field
+func (l *testLogger) events(event string) []map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var out []map[string]interface{}
+	for _, line := range l.lines {
+		if line["event"] == event {
+			out = append(out, line)
+		}
+	}
+	return out
+}
+
+// event returns the only line logged with the given event field
+func (l *testLogger) event(t *testing.T, event string) map[string]interface{} {
+	t.Helper()
+	lines := l.events(event)
+	if len(lines) != 1 {
+		t.Fatalf("got %d %q events, want 1: %v", len(lines), event, l.lines)
+	}
+	return lines[0]
+}
+
+// captureLogs points logger at a testLogger until the test ends
+func captureLogs(t *testing.T) *testLogger {
+	t.Helper()
+	l := &testLogger{}
+	saved, savedAccess := logger, accessLogger
+	logger, accessLogger = l, nil
+	t.Cleanup(func() { logger, accessLogger = saved, savedAccess })
+	return l
+}
+
+func TestMwPanic(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+
+	rec := serve(h, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("code = %d, want 500", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "boom") {
+		t.Errorf("body leaks the panic value: %q", rec.Body.String())
+	}
+	if got := logs.event(t, "panic")["panic_value"]; got != "boom" {
+		t.Errorf("panic_value = %v, want boom", got)
+	}
+}
+
+func TestMwPanicAfterWrite(t *testing.T) {
+	captureLogs(t)
+	h := mwPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "partial")
+		panic("boom")
+	}))
+
+	rec := serve(h, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusAccepted || rec.Body.String() != "partial" {
+		t.Errorf("got %d %q, want the response already started to be left alone", rec.Code, rec.Body.String())
+	}
+}
+
+func TestMwPanicUnderGzip(t *testing.T) {
+	captureLogs(t)
+	h := mwPanic(mwGzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		io.WriteString(w, "partial")
+		panic("boom")
+	})))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec := serve(h, req)
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("code = %d, want the 500 since mwGzip was still holding the response back", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "partial") || rec.Header().Get("Content-Encoding") != "" {
+		t.Errorf("held back output leaked: %q, Content-Encoding %q", rec.Body.String(), rec.Header().Get("Content-Encoding"))
+	}
+}
+
+func TestMwPanicAbortHandler(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+
+	defer func() {
+		if rec := recover(); rec != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler passed on to the server", rec)
+		}
+		if n := len(logs.events("panic")); n != 0 {
+			t.Errorf("logged %d panic events for an abort", n)
+		}
+	}()
+	serve(h, httptest.NewRequest("GET", "/", nil))
+}
+
+func TestMwPanicClientGone(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(r.Context().Err())
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	serve(h, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	logs.event(t, "client_disconnect")
+	if n := len(logs.events("panic")); n != 0 {
+		t.Errorf("a client hanging up logged %d panic events", n)
+	}
+}
+
+func TestMwLogCode(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		want    int
+	}{
+		{"implicit 200", func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") }, 200},
+		{"nothing written", func(w http.ResponseWriter, r *http.Request) {}, 200},
+		{"201", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(201) }, 201},
+		{"404", func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) }, 404},
+		{"500", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(500) }, 500},
+		{"panic", func(w http.ResponseWriter, r *http.Request) { panic("boom") }, 500},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			rec := serve(mwPanic(mwLog(tt.handler)), httptest.NewRequest("GET", "/x", nil))
+			if rec.Code != tt.want {
+				t.Errorf("response code = %d, want %d", rec.Code, tt.want)
+			}
+			if got := logs.event(t, "request")["code"]; got != tt.want {
+				t.Errorf("logged code = %v, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogWriterWriteHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(lw *logWriter)
+		want  int
+	}{
+		{"header then body", func(lw *logWriter) {
+			lw.WriteHeader(http.StatusCreated)
+			lw.Write([]byte("x"))
+		}, http.StatusCreated},
+		{"body then header", func(lw *logWriter) {
+			lw.Write([]byte("x"))
+			lw.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			captureLogs(t)
+			rec := httptest.NewRecorder()
+			lw := newLogWriter(rec, httptest.NewRequest("GET", "/", nil))
+			defer writers.Put(lw)
+			tt.write(lw)
+			if lw.Code() != tt.want {
+				t.Errorf("Code() = %d, want %d", lw.Code(), tt.want)
+			}
+			if rec.Code != tt.want {
+				t.Errorf("sent %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestLogWriterInformational(t *testing.T) {
+	lw := newLogWriter(httptest.NewRecorder(), nil)
+	defer writers.Put(lw)
+	lw.WriteHeader(http.StatusEarlyHints)
+	lw.WriteHeader(http.StatusNoContent)
+	if lw.Code() != http.StatusNoContent {
+		t.Errorf("Code() = %d, want the final status 204", lw.Code())
+	}
+}
+
+func TestNewLogWriterResets(t *testing.T) {
+	lw := newLogWriter(httptest.NewRecorder(), nil)
+	lw.WriteHeader(http.StatusTeapot)
+	lw.Write([]byte("abc"))
+	writers.Put(lw)
+
+	lw = newLogWriter(httptest.NewRecorder(), nil)
+	defer writers.Put(lw)
+	if lw.Code() != http.StatusOK || lw.Bytes() != 0 || lw.headerWritten {
+		t.Errorf("reused writer kept state: code %d, bytes %d, headerWritten %v", lw.Code(), lw.Bytes(), lw.headerWritten)
+	}
+}
+
+func TestMwStageOrder(t *testing.T) {
+	// the order the stages exist to guarantee
+	want := []mwStage{stagePanic, stageRequestID, stageLog, stageMetrics, stageTimeout}
+	for i := 1; i < len(want); i++ {
+		if want[i-1] >= want[i] {
+			t.Errorf("the %s stage should come before the %s stage", want[i-1], want[i])
+		}
+	}
+}
+
+func TestChainBuilderOrder(t *testing.T) {
+	var got []string
+	mark := func(name string) middleware {
+		return func(h http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = append(got, name)
+				h.ServeHTTP(w, r)
+			})
+		}
+	}
+	var mws chainBuilder
+	mws.add(stagePanic, mark("panic"))
+	mws.add(stageRequestID, mark("request id"))
+	mws.add(stageLog, mark("log"))
+	mws.add(stageMetrics, mark("metrics"))
+	mws.add(stageTimeout, mark("timeout"))
+	serve(mws.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = append(got, "app")
+	})), httptest.NewRequest("GET", "/", nil))
+
+	if strings.Join(got, " > ") != "panic > request id > log > metrics > timeout > app" {
+		t.Errorf("ran %q", got)
+	}
+}
+
+func TestChainBuilderMisorder(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("adding the log stage after the timeout stage didn't panic")
+		}
+	}()
+	var mws chainBuilder
+	mws.add(stageTimeout, mwTimeout(time.Second))
+	mws.add(stageLog, mwLog)
+}
+
+func TestChainBuilderObservesFailures(t *testing.T) {
+	logs := captureLogs(t)
+	var mws chainBuilder
+	mws.add(stagePanic, mwPanic)
+	mws.add(stageRequestID, mwRequestID)
+	mws.add(stageLog, mwLog)
+	mws.add(stageTimeout, mwTimeout(10*time.Millisecond))
+	h := mws.handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/panic" {
+			panic("boom")
+		}
+		<-r.Context().Done()
+	}))
+
+	rec := serve(h, httptest.NewRequest("GET", "/slow", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("slow request got %d, want 503", rec.Code)
+	}
+	if got := logs.event(t, "request")["code"]; got != http.StatusServiceUnavailable {
+		t.Errorf("timeout logged as %v, want 503", got)
+	}
+
+	logs = captureLogs(t)
+	rec = serve(h, httptest.NewRequest("GET", "/panic", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("panic got %d, want 500", rec.Code)
+	}
+	id := rec.Header().Get("X-Request-ID")
+	if id == "" || logs.event(t, "panic")["request_id"] != id {
+		t.Errorf("panic event doesn't carry the response's request_id %q", id)
+	}
+}
+
+func TestLogDataAddReachesRequestLine(t *testing.T) {
+	var buf bytes.Buffer
+	saved, savedAccess := logger, accessLogger
+	logger, accessLogger = newJSONLogger(&buf), nil
+	t.Cleanup(func() { logger, accessLogger = saved, savedAccess })
+
+	h := mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the returned request is deliberately dropped, mwLog's map is mutable
+		logDataAdd(r, "user_id", "u42")
+	}))
+	serve(h, httptest.NewRequest("GET", "/", nil))
+
+	var line map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("request line %q isn't one JSON object: %v", buf.String(), err)
+	}
+	if line["event"] != "request" || line["user_id"] != "u42" {
+		t.Errorf("request line is missing the handler's field: %s", buf.String())
+	}
+}
+
+func TestLogDataAddOutsideMwLog(t *testing.T) {
+	r := logDataAdd(httptest.NewRequest("GET", "/", nil), "k", "v")
+	if logDataGet(r)["k"] != "v" {
+		t.Error("the returned request doesn't carry the field")
+	}
+}
+
+// run with -race; the writers pool used to be set up lazily by the first request
+func TestMwLogConcurrent(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logDataAdd(r, "path", r.URL.Path)
+		io.WriteString(w, r.URL.Path)
+	}))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("/%d", i)
+			if rec := serve(h, httptest.NewRequest("GET", path, nil)); rec.Body.String() != path {
+				t.Errorf("%s got %q", path, rec.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	lines := logs.events("request")
+	if len(lines) != 100 {
+		t.Fatalf("logged %d request lines, want 100", len(lines))
+	}
+	for _, line := range lines {
+		if line["url"] != line["path"] {
+			t.Errorf("line for %v carries another request's field %v", line["url"], line["path"])
+		}
+	}
+}
+
+func TestMwLogResponseBytes(t *testing.T) {
+	logs := captureLogs(t)
+	payload := strings.Repeat("x", 1234)
+	h := mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, payload[:1000])
+		io.Copy(w, strings.NewReader(payload[1000:]))
+	}))
+
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	if got := logs.event(t, "request")["response_bytes"]; got != len(payload) {
+		t.Errorf("response_bytes = %v, want %d", got, len(payload))
+	}
+}
+
+func TestNotFoundAndMethodNotAllowed(t *testing.T) {
+	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
+	r.HandleFunc("/things", anotherHandler).Methods(http.MethodGet, http.MethodPost)
+	h := mwLog(r)
+
+	tests := []struct {
+		name, method, path string
+		code               int
+		body, allow        string
+	}{
+		{"unknown path", "GET", "/nope", http.StatusNotFound, `{"error":"not found"}`, ""},
+		{"wrong method", "DELETE", "/things", http.StatusMethodNotAllowed, `{"error":"method not allowed"}`, "GET, POST"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			rec := serve(h, httptest.NewRequest(tt.method, tt.path, nil))
+			if rec.Code != tt.code || strings.TrimSpace(rec.Body.String()) != tt.body {
+				t.Errorf("got %d %q, want %d %s", rec.Code, rec.Body.String(), tt.code, tt.body)
+			}
+			if rec.Header().Get("Content-Type") != "application/json" || rec.Header().Get("Allow") != tt.allow {
+				t.Errorf("Content-Type %q, Allow %q", rec.Header().Get("Content-Type"), rec.Header().Get("Allow"))
+			}
+			if got := logs.event(t, "request")["code"]; got != tt.code {
+				t.Errorf("logged code %v, want %d", got, tt.code)
+			}
+		})
+	}
+}
+
+func TestLogMapsDontLeak(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/first" {
+			logDataAdd(r, "secret_field", "x")
+		}
+	}))
+	serve(h, httptest.NewRequest("GET", "/first", nil))
+	serve(h, httptest.NewRequest("GET", "/second", nil))
+
+	for _, line := range logs.events("request") {
+		if line["url"] == "/second" && line["secret_field"] != nil {
+			t.Error("a field from the previous request leaked through the pool")
+		}
+	}
+}
+
+func BenchmarkMwLog(b *testing.B) {
+	saved, savedAccess := logger, accessLogger
+	logger, accessLogger = newJSONLogger(io.Discard), nil
+	b.Cleanup(func() { logger, accessLogger = saved, savedAccess })
+	h := mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logDataAdd(r, "user_id", "u42")
+		io.WriteString(w, "ok")
+	}))
+	req := httptest.NewRequest("GET", "/bench?x=1", nil)
+	w := httptest.NewRecorder()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		h.ServeHTTP(w, req)
+	}
+}
+
+func TestMwLogDuration(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	}))
+
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	line := logs.event(t, "request")
+	ms, ok := line["duration_ms"].(float64)
+	if !ok || ms < 10 || ms > 500 {
+		t.Errorf("duration_ms = %v, want roughly 10", line["duration_ms"])
+	}
+	if ns, ok := line["duration_ns"].(int64); !ok || ns < int64(10*time.Millisecond) {
+		t.Errorf("duration_ns = %v, want at least 10ms in nanoseconds", line["duration_ns"])
+	}
+	if _, ok := line["tts_ns"]; ok {
+		t.Error("tts_ns logged without -log-tts")
+	}
+}
+
+func TestMwLogTTS(t *testing.T) {
+	logs := captureLogs(t)
+	logTTS = true
+	t.Cleanup(func() { logTTS = false })
+
+	serve(mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})), httptest.NewRequest("GET", "/", nil))
+	if _, ok := logs.event(t, "request")["tts_ns"].(int64); !ok {
+		t.Error("-log-tts didn't keep the legacy tts_ns field")
+	}
+}
+
+func TestMwLogCanceled(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	serve(h, httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	line := logs.event(t, "request")
+	if line["canceled"] != true || line["context_error"] != context.Canceled.Error() {
+		t.Errorf("canceled = %v, context_error = %v", line["canceled"], line["context_error"])
+	}
+
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	if done := logs.events("request")[1]; done["canceled"] != nil || done["context_error"] != nil {
+		t.Errorf("a completed request was logged as canceled: %v", done)
+	}
+}
+
+func TestMwLogTimeoutIsntCanceled(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwLog(mwTimeout(10 * time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	})))
+
+	serve(h, httptest.NewRequest("GET", "/", nil))
+	line := logs.event(t, "request")
+	if line["timed_out"] != true || line["canceled"] != nil {
+		t.Errorf("timed_out = %v, canceled = %v, want only timed_out", line["timed_out"], line["canceled"])
+	}
+}
+
+// headerCounter counts the WriteHeader calls that reach the real writer
+type headerCounter struct {
+	*httptest.ResponseRecorder
+	calls int
+}
+
+func (c *headerCounter) WriteHeader(code int) {
+	c.calls++
+	c.ResponseRecorder.WriteHeader(code)
+}
+
+func TestLogWriterDoubleWriteHeader(t *testing.T) {
+	logs := captureLogs(t)
+	w := &headerCounter{ResponseRecorder: httptest.NewRecorder()}
+	lw := newLogWriter(w, httptest.NewRequest("GET", "/", nil))
+	defer writers.Put(lw)
+
+	lw.WriteHeader(http.StatusOK)
+	lw.WriteHeader(http.StatusInternalServerError)
+	if w.calls != 1 || w.Code != http.StatusOK || lw.Code() != http.StatusOK {
+		t.Errorf("%d underlying writes, sent %d, Code() %d; want one write of 200", w.calls, w.Code, lw.Code())
+	}
+	logs.event(t, "superfluous_write_header")
+}
+
+// fakePusher records the pushes that reach it
+type fakePusher struct {
+	*httptest.ResponseRecorder
+	targets []string
+}
+
+func (p *fakePusher) Push(target string, opts *http.PushOptions) error {
+	p.targets = append(p.targets, target)
+	return nil
+}
+
+func TestLogWriterPush(t *testing.T) {
+	p := &fakePusher{ResponseRecorder: httptest.NewRecorder()}
+	lw := newLogWriter(p, nil)
+	defer writers.Put(lw)
+	if err := lw.Push("/app.css", nil); err != nil || len(p.targets) != 1 || p.targets[0] != "/app.css" {
+		t.Errorf("Push returned %v, pusher saw %q", err, p.targets)
+	}
+
+	plain := newLogWriter(httptest.NewRecorder(), nil)
+	defer writers.Put(plain)
+	if err := plain.Push("/app.css", nil); err != http.ErrNotSupported {
+		t.Errorf("Push without a pusher returned %v, want http.ErrNotSupported", err)
+	}
+}
+
+// readerFromRecorder notes whether ReadFrom was used
+type readerFromRecorder struct {
+	*httptest.ResponseRecorder
+	used bool
+}
+
+func (r *readerFromRecorder) ReadFrom(src io.Reader) (int64, error) {
+	r.used = true
+	return io.Copy(r.ResponseRecorder, src)
+}
+
+func TestLogWriterReadFrom(t *testing.T) {
+	rf := &readerFromRecorder{ResponseRecorder: httptest.NewRecorder()}
+	lw := newLogWriter(rf, nil)
+	defer writers.Put(lw)
+	n, err := lw.ReadFrom(strings.NewReader("hello"))
+	if err != nil || n != 5 || !rf.used || lw.Bytes() != 5 || !lw.headerWritten {
+		t.Errorf("ReadFrom = %d, %v; delegated %v, Bytes() %d", n, err, rf.used, lw.Bytes())
+	}
+
+	plain := newLogWriter(httptest.NewRecorder(), nil)
+	defer writers.Put(plain)
+	if n, err := plain.ReadFrom(strings.NewReader("hello")); err != nil || n != 5 || plain.Bytes() != 5 {
+		t.Errorf("fallback ReadFrom = %d, %v; Bytes() %d", n, err, plain.Bytes())
+	}
+}
+
+// writeOnly hides every method but those of http.ResponseWriter, the way
+// logWriter looked before it had ReadFrom
+type writeOnly struct{ w http.ResponseWriter }
+
+func (o writeOnly) Header() http.Header         { return o.w.Header() }
+func (o writeOnly) Write(b []byte) (int, error) { return o.w.Write(b) }
+func (o writeOnly) WriteHeader(code int)        { o.w.WriteHeader(code) }
+
+func BenchmarkServeLargeFile(b *testing.B) {
+	saved, savedAccess := logger, accessLogger
+	logger, accessLogger = newJSONLogger(io.Discard), nil
+	b.Cleanup(func() { logger, accessLogger = saved, savedAccess })
+
+	dir := b.TempDir()
+	const size = 8 << 20
+	if err := os.WriteFile(filepath.Join(dir, "big.bin"), bytes.Repeat([]byte{1}, size), 0o644); err != nil {
+		b.Fatal(err)
+	}
+	files := http.FileServer(http.Dir(dir))
+
+	for name, h := range map[string]http.Handler{
+		"readfrom": files,
+		"copy":     http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { files.ServeHTTP(writeOnly{w}, r) }),
+	} {
+		b.Run(name, func(b *testing.B) {
+			srv := httptest.NewServer(mwLog(h))
+			defer srv.Close()
+			b.SetBytes(size)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				resp, err := http.Get(srv.URL + "/big.bin")
+				if err != nil {
+					b.Fatal(err)
+				}
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		})
+	}
+}
+
+func TestPanicEventSharesRequestID(t *testing.T) {
+	panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { panic("boom") })
+	chains := map[string]http.Handler{
+		"with mwRequestID":    mwPanic(mwRequestID(mwLog(panicking))),
+		"without mwRequestID": mwPanic(mwLog(panicking)),
+	}
+	for name, h := range chains {
+		t.Run(name, func(t *testing.T) {
+			logs := captureLogs(t)
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Request-ID", "upstream-1")
+			serve(h, req)
+
+			panicID := logs.event(t, "panic")["request_id"]
+			if panicID != "upstream-1" || logs.event(t, "request")["request_id"] != panicID {
+				t.Errorf("panic request_id %v, request line %v; want both upstream-1", panicID, logs.event(t, "request")["request_id"])
+			}
+		})
+	}
+}
+
+func TestMwPanicNegotiatesFormat(t *testing.T) {
+	tests := []struct {
+		accept, contentType, contains string
+	}{
+		{"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", "text/html; charset=utf-8", "<h1>Internal Server Error</h1>"},
+		{"application/json", "application/json", `"error":"internal server error"`},
+		{"*/*", "application/json", `"error":"internal server error"`},
+		{"", "application/json", `"error":"internal server error"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			captureLogs(t)
+			h := mwPanic(mwRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				panic("secret detail")
+			})))
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			rec := serve(h, req)
+			body := rec.Body.String()
+			if rec.Header().Get("Content-Type") != tt.contentType || !strings.Contains(body, tt.contains) {
+				t.Errorf("got %q: %s", rec.Header().Get("Content-Type"), body)
+			}
+			if !strings.Contains(body, rec.Header().Get("X-Request-ID")) {
+				t.Error("the error page doesn't carry the request ID")
+			}
+			if strings.Contains(body, "secret detail") || strings.Contains(body, "goroutine") || strings.Contains(body, ".go:") {
+				t.Errorf("the response leaks the panic or its stack: %s", body)
+			}
+		})
+	}
+}
+
+func TestMwPanicWithOptions(t *testing.T) {
+	captureLogs(t)
+	var hooked interface{}
+	opts := panicOptions{
+		code:        http.StatusServiceUnavailable,
+		contentType: "text/plain",
+		body:        func(r *http.Request) []byte { return []byte("try later") },
+		hook:        func(r *http.Request, rec interface{}, stack []byte) { hooked = rec },
+	}
+	rec := serve(mwPanicWith(opts)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	})), httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "try later" || hooked != "boom" {
+		t.Errorf("got %d %q, hook saw %v", rec.Code, rec.Body.String(), hooked)
+	}
+}
+
+func TestRequestTimeFormats(t *testing.T) {
+	start := time.Date(2026, 3, 4, 5, 6, 7, 891011121, time.FixedZone("x", 3600))
+	t.Cleanup(func() { logTimeFormat = "unix" })
+
+	logTimeFormat = "unix"
+	data := map[string]interface{}{}
+	addRequestTime(data, start)
+	if data["request_time"] != start.Unix() {
+		t.Errorf("unix request_time = %v", data["request_time"])
+	}
+
+	for _, format := range []string{"rfc3339", "both"} {
+		logTimeFormat = format
+		data := map[string]interface{}{}
+		addRequestTime(data, start)
+		field := "request_time"
+		if format == "both" {
+			field = "request_timestamp"
+			if data["request_time"] != start.Unix() {
+				t.Errorf("both: request_time = %v, want the unix seconds kept", data["request_time"])
+			}
+		}
+		s, _ := data[field].(string)
+		parsed, err := time.Parse(time.RFC3339Nano, s)
+		if err != nil || !parsed.Equal(start) {
+			t.Errorf("%s: %s = %q doesn't parse back to the start time: %v", format, field, s, err)
+		}
+	}
+}
+
+func TestNewServerDisableKeepAlive(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		cfg := defaultConfig()
+		cfg.DisableKeepAlive = disable
+		h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { io.WriteString(w, "ok") })
+		ts := httptest.NewUnstartedServer(h)
+		ts.Config = newServer(cfg, h)
+		ts.Start()
+
+		resp, err := ts.Client().Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		ts.Close()
+
+		// the client consumes Connection: close into resp.Close
+		if resp.Close != disable {
+			t.Errorf("disable-keepalive %v: got Connection: close %v", disable, resp.Close)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// maintenancePath is where maintenanceHandler is mounted, behind mwAuth
+const maintenancePath = "/private/maintenance"
+
+// maintenance is whether app routes are turned away with a 503, see mwMaintenance
+var maintenance atomic.Bool
+
+// setMaintenance turns maintenance mode on or off, logging who changed it when
+// that's an actual transition. r may be nil.
+func setMaintenance(r *http.Request, on bool) {
+	if maintenance.Swap(on) == on {
+		return
+	}
+	if on {
+		logEventLevel(r, levelWarn, "maintenance_on", "app routes now answer 503")
+	} else {
+		logEventLevel(r, levelWarn, "maintenance_off", "app routes are back")
+	}
+}
+
+// mwMaintenance answers every request with a JSON 503 and a Retry-After of
+// retryAfter while maintenance mode is on, except those for the paths in exempt.
+// Those should be the ops paths, the toggle itself and anything a monitor scrapes,
+// so turning maintenance on doesn't also blind the dashboards. Empty paths are
+// ignored.
+func mwMaintenance(retryAfter time.Duration, exempt ...string) middleware {
+	skip := make(map[string]bool, len(exempt))
+	for _, p := range exempt {
+		if p != "" {
+			skip[p] = true
+		}
+	}
+	seconds := strconv.Itoa(int(retryAfter.Seconds()))
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !maintenance.Load() || skip[r.URL.Path] {
+				h.ServeHTTP(w, r)
+				return
+			}
+			logDataAdd(r, "maintenance", true)
+			w.Header().Set("Retry-After", seconds)
+			writeJSON(w, r, http.StatusServiceUnavailable, map[string]string{"error": "down for maintenance"})
+		})
+	}
+}
+
+// maintenanceHandler reports maintenance mode on GET, and sets it on POST from the
+// on query parameter, e.g. POST to maintenancePath?on=true
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		on, err := strconv.ParseBool(r.URL.Query().Get("on"))
+		if err != nil {
+			writeJSON(w, r, http.StatusBadRequest, map[string]string{"error": "on must be true or false"})
+			return
+		}
+		setMaintenance(r, on)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, r, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+	writeJSON(w, r, http.StatusOK, map[string]bool{"maintenance": maintenance.Load()})
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMwMaintenanceToggle(t *testing.T) {
+	logs := captureLogs(t)
+	t.Cleanup(func() { maintenance.Store(false) })
+	app := mwMaintenance(30*time.Second, maintenancePath, "/metrics", "")(http.HandlerFunc(maintenanceHandler))
+	toggle := func(on string) *httptest.ResponseRecorder {
+		return serve(app, httptest.NewRequest("POST", maintenancePath+"?on="+on, nil))
+	}
+
+	if rec := serve(app, httptest.NewRequest("GET", "/x", nil)); rec.Code != http.StatusOK {
+		t.Fatalf("before maintenance got %d, want 200", rec.Code)
+	}
+
+	if rec := toggle("true"); rec.Code != http.StatusOK {
+		t.Fatalf("turning maintenance on got %d", rec.Code)
+	}
+	logs.event(t, "maintenance_on")
+	rec := serve(app, httptest.NewRequest("GET", "/x", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "30" {
+		t.Errorf("during maintenance got %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	var body map[string]string
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil || body["error"] == "" {
+		t.Errorf("503 body %q isn't a JSON error", rec.Body.String())
+	}
+	for _, path := range []string{maintenancePath, "/metrics"} {
+		if rec := serve(app, httptest.NewRequest("GET", path, nil)); rec.Code != http.StatusOK {
+			t.Errorf("%s is exempt but got %d", path, rec.Code)
+		}
+	}
+
+	toggle("true")
+	if n := len(logs.events("maintenance_on")); n != 1 {
+		t.Errorf("turning it on twice logged %d transitions, want 1", n)
+	}
+	toggle("false")
+	logs.event(t, "maintenance_off")
+	if rec := serve(app, httptest.NewRequest("GET", "/x", nil)); rec.Code != http.StatusOK {
+		t.Errorf("after maintenance got %d, want 200", rec.Code)
+	}
+}
+
+func TestMaintenanceHandlerBadInput(t *testing.T) {
+	captureLogs(t)
+	if rec := serve(http.HandlerFunc(maintenanceHandler), httptest.NewRequest("POST", maintenancePath+"?on=maybe", nil)); rec.Code != http.StatusBadRequest {
+		t.Errorf("on=maybe got %d, want 400", rec.Code)
+	}
+	rec := serve(http.HandlerFunc(maintenanceHandler), httptest.NewRequest("DELETE", maintenancePath, nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("DELETE got %d, Allow %q", rec.Code, rec.Header().Get("Allow"))
+	}
+	if maintenance.Load() {
+		t.Error("bad input changed maintenance mode")
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics receives the per-request measurements mwMetrics takes, so they can go
+// to Prometheus, StatsD, or anything else. Implementations must be safe for
+// concurrent use.
+type Metrics interface {
+	IncRequest(route, method string, status int)
+	ObserveLatency(route string, d time.Duration)
+}
+
+// noopMetrics discards everything
+type noopMetrics struct{}
+
+func (noopMetrics) IncRequest(route, method string, status int)  {}
+func (noopMetrics) ObserveLatency(route string, d time.Duration) {}
+
+// metrics is the Prometheus Metrics. Build one per registry with newMetrics;
+// tests can pass a fresh prometheus.NewRegistry() to avoid global state.
+type metrics struct {
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+}
+
+func newMetrics(reg prometheus.Registerer) *metrics {
+	m := &metrics{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests served, by method, route template, and status code.",
+		}, []string{"method", "route", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time to serve HTTP requests, by route template.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route"}),
+	}
+	inflightGauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "http_requests_in_flight",
+		Help: "HTTP requests currently being handled.",
+	}, func() float64 { return float64(inflight.Load()) })
+	connsGauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "http_connections_open",
+		Help: "Client connections currently open, idle keep-alives included.",
+	}, func() float64 { return float64(openConns.Load()) })
+	reg.MustRegister(m.requests, m.latency, inflightGauge, connsGauge)
+	return m
+}
+
+func (m *metrics) IncRequest(route, method string, status int) {
+	m.requests.WithLabelValues(method, route, strconv.Itoa(status)).Inc()
+}
+
+func (m *metrics) ObserveLatency(route string, d time.Duration) {
+	m.latency.WithLabelValues(route).Observe(d.Seconds())
+}
+
+// mwMetrics records request counts and latency. Routes are labeled by their mux
+// template, recorded by mwRoute, so label cardinality stays bounded; requests that
+// matched no route are labeled "unmatched".
+func mwMetrics(m Metrics) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			// make sure there is a shared log map for mwRoute to fill in
+			r, data, owned := logDataEnsure(r)
+			if owned {
+				defer logDataRelease(data)
+			}
+
+			lw := newLogWriter(w, r)
+			defer writers.Put(lw)
+
+			h.ServeHTTP(lw, r)
+
+			route, ok := data["route"].(string)
+			if !ok {
+				route = "unmatched"
+			}
+			m.IncRequest(route, r.Method, lw.Code())
+			m.ObserveLatency(route, time.Since(start))
+		})
+	}
+}
+
+// mwRoute records the matched route template, e.g. /users/{id}, as route, the
+// route's name (set with Name when registering) as handler, and the extracted
+// variables as path_vars in the log data. Register it on the router with
+// r.Use so it runs after matching; requests that match no route (404s and 405s)
+// never reach it and are logged without either field.
+func mwRoute(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tmpl, err := route.GetPathTemplate(); err == nil {
+				addRouteField(r, "route", tmpl)
+			}
+			if name := route.GetName(); name != "" {
+				addRouteField(r, "handler", name)
+			}
+		}
+		if vars := mux.Vars(r); len(vars) > 0 {
+			addRouteField(r, "path_vars", vars)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// addRouteField sets key on the log data and, behind mwTimeout, on the
+// routeFields it copies back when the handler times out
+func addRouteField(r *http.Request, key string, value interface{}) {
+	logDataAdd(r, key, value)
+	if rf, ok := routeFieldsFrom(r.Context()); ok {
+		rf.mu.Lock()
+		rf.fields[key] = value
+		rf.mu.Unlock()
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMwRouteHandlerName(t *testing.T) {
+	captureLogs(t)
+	saved := authUsers
+	authUsers = map[string]string{"bob": "pw"}
+	t.Cleanup(func() { authUsers = saved })
+	r, err := newRouter(defaultConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	users := r.PathPrefix("/users").Subrouter()
+	registerRoutes(users, []route{{name: "user", path: "/{id}", handler: anotherHandler}}, nil)
+	h := mwLog(r)
+
+	tests := []struct {
+		target, handler, route string
+	}{
+		{"/version", "version", "/version"},
+		{"/private/auth", "private_auth", "/private/auth"},
+		{"/users/42", "user", "/users/{id}"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			logs := captureLogs(t)
+			req := httptest.NewRequest("GET", tt.target, nil)
+			req.SetBasicAuth("bob", "pw")
+			serve(h, req)
+			line := logs.event(t, "request")
+			if line["handler"] != tt.handler || line["route"] != tt.route {
+				t.Errorf("handler %v, route %v; want %s, %s", line["handler"], line["route"], tt.handler, tt.route)
+			}
+		})
+	}
+
+	logs := captureLogs(t)
+	serve(h, httptest.NewRequest("GET", "/users/42", nil))
+	if vars, _ := logs.event(t, "request")["path_vars"].(map[string]string); vars["id"] != "42" {
+		t.Errorf("path_vars = %v", vars)
+	}
+}
+
+func TestMwRouteUnmatched(t *testing.T) {
+	logs := captureLogs(t)
+	r := mux.NewRouter()
+	r.Use(mwRoute)
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	serve(mwLog(r), httptest.NewRequest("GET", "/nope", nil))
+	if _, ok := logs.event(t, "request")["handler"]; ok {
+		t.Error("a 404 was logged with a handler name")
+	}
+}
+
+// fakeMetrics records the calls mwMetrics makes
+type fakeMetrics struct {
+	mu        sync.Mutex
+	requests  []string
+	latencies map[string]time.Duration
+}
+
+func (m *fakeMetrics) IncRequest(route, method string, status int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests = append(m.requests, fmt.Sprintf("%s %s %d", method, route, status))
+}
+
+func (m *fakeMetrics) ObserveLatency(route string, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latencies == nil {
+		m.latencies = map[string]time.Duration{}
+	}
+	m.latencies[route] += d
+}
+
+func TestMwMetrics(t *testing.T) {
+	r := mux.NewRouter()
+	r.Use(mwRoute)
+	r.HandleFunc("/users/{id}", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+		w.WriteHeader(http.StatusAccepted)
+	})
+	m := &fakeMetrics{}
+	h := mwMetrics(m)(r)
+
+	serve(h, httptest.NewRequest("GET", "/users/1", nil))
+	serve(h, httptest.NewRequest("POST", "/users/2", nil))
+	serve(h, httptest.NewRequest("GET", "/nope", nil))
+
+	want := []string{"GET /users/{id} 202", "POST /users/{id} 202", "GET unmatched 404"}
+	if fmt.Sprint(m.requests) != fmt.Sprint(want) {
+		t.Errorf("IncRequest calls = %q, want %q", m.requests, want)
+	}
+	if d := m.latencies["/users/{id}"]; d < 10*time.Millisecond {
+		t.Errorf("observed %v for two 5ms requests", d)
+	}
+	if _, ok := m.latencies["unmatched"]; !ok {
+		t.Error("no latency observed for the unmatched request")
+	}
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	m := newMetrics(reg)
+	m.IncRequest("/users/{id}", "GET", 200)
+	m.IncRequest("/users/{id}", "GET", 200)
+	m.ObserveLatency("/users/{id}", 30*time.Millisecond)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]float64{}
+	for _, f := range families {
+		for _, metric := range f.GetMetric() {
+			switch {
+			case metric.Counter != nil:
+				got[f.GetName()] += metric.Counter.GetValue()
+			case metric.Histogram != nil:
+				got[f.GetName()] += float64(metric.Histogram.GetSampleCount())
+			}
+		}
+	}
+	if got["http_requests_total"] != 2 || got["http_request_duration_seconds"] != 1 {
+		t.Errorf("gathered %v", got)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// httpClient is for calls from handlers to other services. Build requests with
+// http.NewRequestWithContext(r.Context(), ...) so it can forward the incoming
+// request's ID and trace, see correlatingTransport.
+var httpClient = &http.Client{
+	Transport: correlatingTransport{base: http.DefaultTransport},
+	Timeout:   30 * time.Second,
+}
+
+// correlatingTransport sets X-Request-ID and the W3C trace headers on outbound
+// requests from what mwRequestID and mwTrace left in the request's context, so
+// logs can be followed across services. Headers already set are left alone.
+type correlatingTransport struct {
+	base http.RoundTripper
+}
+
+func (t correlatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	// RoundTrippers mustn't modify the caller's request
+	req = req.Clone(ctx)
+	if req.Header.Get("X-Request-ID") == "" {
+		if data, ok := logDataFrom(ctx); ok {
+			if id, ok := data["request_id"].(string); ok {
+				req.Header.Set("X-Request-ID", id)
+			}
+		}
+	}
+	if req.Header.Get("traceparent") == "" {
+		tracePropagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+	}
+	return t.base.RoundTrip(req)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// roundTripperFunc answers outbound requests without a network
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// correlatingClient sends through correlatingTransport, keeping the headers
+// that would have gone out in sent
+func correlatingClient(sent *http.Header) *http.Client {
+	return &http.Client{Transport: correlatingTransport{base: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		*sent = req.Header
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+	})}}
+}
+
+func TestCorrelatingTransport(t *testing.T) {
+	captureLogs(t)
+	const traceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	var sent http.Header
+	client := correlatingClient(&sent)
+
+	tests := []struct {
+		name           string
+		preset, wantID string
+	}{
+		{"forwarded", "", "req-1"},
+		{"caller's header wins", "mine", "mine"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := mwLog(mwTrace(tracerProvider)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				out, _ := http.NewRequestWithContext(r.Context(), "GET", "http://downstream/", nil)
+				if tt.preset != "" {
+					out.Header.Set("X-Request-ID", tt.preset)
+				}
+				resp, err := client.Do(out)
+				if err != nil {
+					t.Fatal(err)
+				}
+				resp.Body.Close()
+				if out.Header.Get("traceparent") != "" {
+					t.Error("the transport modified the caller's request")
+				}
+			})))
+
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("X-Request-ID", "req-1")
+			req.Header.Set("traceparent", traceparent)
+			serve(h, req)
+
+			if got := sent.Get("X-Request-ID"); got != tt.wantID {
+				t.Errorf("X-Request-ID = %q, want %q", got, tt.wantID)
+			}
+			if got := sent.Get("traceparent"); got != traceparent {
+				t.Errorf("traceparent = %q, want %q", got, traceparent)
+			}
+		})
+	}
+}
+
+func TestCorrelatingTransportWithoutRequest(t *testing.T) {
+	var sent http.Header
+	client := correlatingClient(&sent)
+	resp, err := client.Get("http://downstream/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if sent.Get("X-Request-ID") != "" || sent.Get("traceparent") != "" {
+		t.Errorf("a background call got correlation headers: %v", sent)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// overridableMethods are the only methods a POST can be turned into. GET and HEAD
+// are left out since they must be safe, and a POST shouldn't become one.
+var overridableMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodPatch:  true,
+	http.MethodDelete: true,
+}
+
+// mwMethodOverride lets clients limited to GET and POST reach PUT, PATCH, and
+// DELETE routes: a POST with an X-HTTP-Method-Override header, or a _method field
+// in a urlencoded form body, is routed as that method. It must run before the
+// router, and anything but the methods above is ignored.
+func mwMethodOverride(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			h.ServeHTTP(w, r)
+			return
+		}
+		method := r.Header.Get("X-HTTP-Method-Override")
+		if method == "" {
+			if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/x-www-form-urlencoded" {
+				method = r.PostFormValue("_method")
+			}
+		}
+		method = strings.ToUpper(strings.TrimSpace(method))
+		if overridableMethods[method] {
+			logDataAdd(r, "method_override", method)
+			// a shallow copy, so outer middleware still see the POST
+			r = r.WithContext(r.Context())
+			r.Method = method
+		}
+		h.ServeHTTP(w, r)
+	})
+}
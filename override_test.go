@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMwMethodOverride(t *testing.T) {
+	tests := []struct {
+		name, method, header, form, want string
+	}{
+		{"header", "POST", "DELETE", "", "DELETE"},
+		{"header lowercase", "POST", " patch ", "", "PATCH"},
+		{"form field", "POST", "", "_method=PUT&name=a", "PUT"},
+		{"header wins over form", "POST", "PATCH", "_method=PUT", "PATCH"},
+		{"no override", "POST", "", "", "POST"},
+		{"not to GET", "POST", "GET", "", "POST"},
+		{"not to nonsense", "POST", "BREW", "", "POST"},
+		{"not to CONNECT", "POST", "", "_method=CONNECT", "POST"},
+		{"only from POST", "GET", "DELETE", "", "GET"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			h := mwMethodOverride(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = r.Method
+			}))
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.form))
+			if tt.form != "" {
+				req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+			if tt.header != "" {
+				req.Header.Set("X-HTTP-Method-Override", tt.header)
+			}
+			serve(h, req)
+			if got != tt.want {
+				t.Errorf("routed as %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMwMethodOverrideFormStillReadable(t *testing.T) {
+	var name string
+	h := mwMethodOverride(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name = r.FormValue("name")
+	}))
+	req := httptest.NewRequest("POST", "/", strings.NewReader("_method=PUT&name=a"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	serve(h, req)
+	if name != "a" {
+		t.Errorf("handler read name %q from the form, want a", name)
+	}
+}
+
+func TestMwMethodOverrideJSONBodyUntouched(t *testing.T) {
+	var method string
+	h := mwMethodOverride(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { method = r.Method }))
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"_method":"DELETE"}`))
+	req.Header.Set("Content-Type", "application/json")
+	serve(h, req)
+	if method != "POST" {
+		t.Errorf("a JSON body was treated as a form, routed as %s", method)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+)
+
+// trustedProxies are the peers whose X-Forwarded-For and X-Real-IP headers are
+// believed, populated from -trusted-proxies
+var trustedProxies []netip.Prefix
+
+// parseCIDRs parses a comma separated list of CIDRs. Bare IPs are taken as a /32 or /128.
+func parseCIDRs(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if !strings.Contains(c, "/") {
+			ip, err := netip.ParseAddr(c)
+			if err != nil {
+				return nil, err
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// isTrustedProxy reports whether ip is in one of the trustedProxies
+func isTrustedProxy(ip string) bool {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range trustedProxies {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP is the IP of the direct peer, without the port. That's from before
+// mwProxyHeaders replaced RemoteAddr, so trust decisions stay about the proxy.
+func peerIP(r *http.Request) string {
+	addr := r.RemoteAddr
+	if peer, ok := r.Context().Value(peerAddrKey).(string); ok {
+		addr = peer
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIP figures out the address of the real client. Forwarding headers are only
+// used when the direct peer is a trusted proxy, since anyone can send them.
+// X-Forwarded-For is walked right to left, skipping trusted proxies, so a client
+// can't spoof its address by sending its own X-Forwarded-For.
+func clientIP(r *http.Request) string {
+	peer := peerIP(r)
+	if !isTrustedProxy(peer) {
+		return peer
+	}
+
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if _, err := netip.ParseAddr(hop); err != nil {
+				break
+			}
+			if i == 0 || !isTrustedProxy(hop) {
+				return hop
+			}
+		}
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		if _, err := netip.ParseAddr(realIP); err == nil {
+			return realIP
+		}
+	}
+	return peer
+}
+
+// requestScheme is "https" when the client's connection was TLS, either to us or,
+// per X-Forwarded-Proto, to a trusted proxy in front of us. The header is ignored
+// from anyone else, since clients could claim https over plain HTTP.
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	if isTrustedProxy(peerIP(r)) {
+		// the first entry is the proxy nearest the client
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if strings.EqualFold(strings.TrimSpace(proto), "https") {
+			return "https"
+		}
+	}
+	return "http"
+}
+
+// mwRequireHTTPS records the requestScheme as scheme in the log data and turns
+// away plain HTTP requests: with a 308 to the https URL when redirect is set,
+// otherwise with a 403. host is as for mwHTTPSRedirect.
+func mwRequireHTTPS(redirect bool, host string) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			scheme := requestScheme(r)
+			logDataAdd(r, "scheme", scheme)
+			if scheme == "https" {
+				h.ServeHTTP(w, r)
+				return
+			}
+			if target := httpsURL(r, host); redirect && target != "" {
+				http.Redirect(w, r, target, http.StatusPermanentRedirect)
+				return
+			}
+			logEvent(r, "https_required", "rejected a plain HTTP request")
+			writeJSON(w, r, http.StatusForbidden, map[string]string{"error": "https required"})
+		})
+	}
+}
+
+// mwProxyHeaders makes requests through a trusted proxy look the way the client
+// sent them: RemoteAddr becomes the clientIP, r.Host the X-Forwarded-Host, and
+// r.URL.Scheme the requestScheme, so generated links point at the public URL.
+// Requests from anyone else are left alone, so the headers can't be spoofed. It
+// belongs before anything that looks at the host, like mwAllowedHosts.
+func mwProxyHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isTrustedProxy(peerIP(r)) {
+			h.ServeHTTP(w, r)
+			return
+		}
+
+		// a shallow copy, so outer middleware, mwLog included, still see the proxy
+		r = r.WithContext(context.WithValue(r.Context(), peerAddrKey, r.RemoteAddr))
+		u := *r.URL
+		r.URL = &u
+		r.URL.Scheme = requestScheme(r)
+		r.RemoteAddr = clientIP(r)
+		// the first entry is the host the client asked for
+		host, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+		if host = strings.TrimSpace(host); validHost(host) {
+			logDataAdd(r, "forwarded_host", host)
+			r.Host = host
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// validHost reports whether host is a bare host or host:port, with nothing that
+// would change the meaning of a URL built from it
+func validHost(host string) bool {
+	if host == "" {
+		return false
+	}
+	u, err := url.Parse("//" + host)
+	return err == nil && u.Host == host && u.User == nil && u.Path == ""
+}
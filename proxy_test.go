@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// trustProxies sets trustedProxies from cidrs until the test ends
+func trustProxies(t *testing.T, cidrs string) {
+	t.Helper()
+	prefixes, err := parseCIDRs(cidrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := trustedProxies
+	trustedProxies = prefixes
+	t.Cleanup(func() { trustedProxies = saved })
+}
+
+func TestMwRequireHTTPS(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+	tests := []struct {
+		name, remote, proto string
+		tls                 bool
+		scheme              string
+	}{
+		{"direct TLS", "192.0.2.1:1234", "", true, "https"},
+		{"trusted proxy https", "10.0.0.5:1234", "https", false, "https"},
+		{"trusted proxy list", "10.0.0.5:1234", "HTTPS, http", false, "https"},
+		{"trusted proxy http", "10.0.0.5:1234", "http", false, "http"},
+		{"untrusted claims https", "192.0.2.1:1234", "https", false, "http"},
+		{"plain", "192.0.2.1:1234", "", false, "http"},
+	}
+	for _, tt := range tests {
+		for _, redirect := range []bool{false, true} {
+			logs := captureLogs(t)
+			req := httptest.NewRequest("GET", "/a?b=1", nil)
+			req.Host = "example.com"
+			req.RemoteAddr = tt.remote
+			if tt.proto != "" {
+				req.Header.Set("X-Forwarded-Proto", tt.proto)
+			}
+			if tt.tls {
+				req.TLS = &tls.ConnectionState{}
+			}
+			rec := serve(mwLog(mwRequireHTTPS(redirect, "")(http.HandlerFunc(anotherHandler))), req)
+
+			want := http.StatusOK
+			switch {
+			case tt.scheme == "https":
+			case redirect:
+				want = http.StatusPermanentRedirect
+			default:
+				want = http.StatusForbidden
+			}
+			if rec.Code != want {
+				t.Errorf("%s, redirect %v: got %d, want %d", tt.name, redirect, rec.Code, want)
+			}
+			if want == http.StatusPermanentRedirect && rec.Header().Get("Location") != "https://example.com/a?b=1" {
+				t.Errorf("%s: redirected to %q", tt.name, rec.Header().Get("Location"))
+			}
+			if got := logs.event(t, "request")["scheme"]; got != tt.scheme {
+				t.Errorf("%s: logged scheme %v, want %s", tt.name, got, tt.scheme)
+			}
+		}
+	}
+}
+
+func TestMwProxyHeaders(t *testing.T) {
+	trustProxies(t, "10.0.0.0/8")
+	tests := []struct {
+		name, remote, xff, host     string
+		wantRemote, wantHost, proto string
+	}{
+		{"trusted", "10.0.0.5:1234", "203.0.113.7", "public.example.com", "203.0.113.7", "public.example.com", "https"},
+		{"trusted, client sent its own XFF", "10.0.0.5:1234", "6.6.6.6, 203.0.113.7", "public.example.com", "203.0.113.7", "public.example.com", "https"},
+		{"trusted, host list", "10.0.0.5:1234", "203.0.113.7", "public.example.com, internal:8080", "203.0.113.7", "public.example.com", "https"},
+		{"trusted, bad host", "10.0.0.5:1234", "203.0.113.7", "evil.example/path", "203.0.113.7", "example.com", "https"},
+		{"trusted, userinfo host", "10.0.0.5:1234", "203.0.113.7", "user@evil.example", "203.0.113.7", "example.com", "https"},
+		{"untrusted", "192.0.2.1:1234", "203.0.113.7", "public.example.com", "192.0.2.1:1234", "example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			var seen *http.Request
+			h := mwLog(mwProxyHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				seen = r
+			})))
+
+			req := httptest.NewRequest("GET", "/a", nil)
+			req.Host = "example.com"
+			req.RemoteAddr = tt.remote
+			req.Header.Set("X-Forwarded-For", tt.xff)
+			req.Header.Set("X-Forwarded-Host", tt.host)
+			req.Header.Set("X-Forwarded-Proto", "https")
+			serve(h, req)
+
+			if seen.RemoteAddr != tt.wantRemote || seen.Host != tt.wantHost || seen.URL.Scheme != tt.proto {
+				t.Errorf("handler saw RemoteAddr %q, Host %q, scheme %q; want %q, %q, %q",
+					seen.RemoteAddr, seen.Host, seen.URL.Scheme, tt.wantRemote, tt.wantHost, tt.proto)
+			}
+			// the rewrite is the handler's; the request line still names the proxy
+			if got := logs.event(t, "request")["remote_addr"]; got != tt.remote {
+				t.Errorf("logged remote_addr %v, want the peer %s", got, tt.remote)
+			}
+			if req.Host != "example.com" || req.RemoteAddr != tt.remote || req.URL.Scheme != "" {
+				t.Error("the caller's request was modified")
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// rateLimitIdle is how long a client's bucket is kept after its last request.
+// Idle buckets are full again by then anyway, so dropping them loses nothing.
+var rateLimitIdle = 5 * time.Minute
+
+// mwRateLimit gives each client IP (see clientIP) a token bucket refilling at
+// perSecond with room for burst requests. Requests over the limit get a 429 with
+// Retry-After. Each call makes an independent limiter, so routes can have their own.
+func mwRateLimit(perSecond float64, burst int) middleware {
+	rl := &rateLimiter{
+		limit:   rate.Limit(perSecond),
+		burst:   burst,
+		clients: make(map[string]*rateClient),
+	}
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip := clientIP(r)
+			res := rl.reserve(ip)
+			if delay := res.Delay(); delay > 0 {
+				res.Cancel()
+				logEvent(r, "rate_limited", fmt.Sprintf("%s over %g requests per second", ip, perSecond))
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+				writeJSON(w, r, http.StatusTooManyRequests, map[string]string{"error": "too many requests"})
+				return
+			}
+			h.ServeHTTP(w, r)
+		})
+	}
+}
+
+type rateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mu        sync.Mutex
+	clients   map[string]*rateClient
+	lastSweep time.Time
+}
+
+type rateClient struct {
+	limiter *rate.Limiter
+	seen    time.Time
+}
+
+// reserve takes a token from key's bucket, creating the bucket if needed, and
+// every so often forgets idle clients so the map can't grow without bound
+func (rl *rateLimiter) reserve(key string) *rate.Reservation {
+	now := time.Now()
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if now.Sub(rl.lastSweep) > rateLimitIdle {
+		for k, c := range rl.clients {
+			if now.Sub(c.seen) > rateLimitIdle {
+				delete(rl.clients, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	c, ok := rl.clients[key]
+	if !ok {
+		c = &rateClient{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[key] = c
+	}
+	c.seen = now
+	return c.limiter.ReserveN(now, 1)
+}
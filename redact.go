@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const redacted = "[REDACTED]"
+
+// redactedHeaders are never logged with their values. Keys are canonical header names.
+var redactedHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"Set-Cookie":    true,
+	"X-Api-Key":     true,
+}
+
+// redactedParams are query parameters whose values are never logged
+var redactedParams = map[string]bool{
+	"access_token": true,
+	"api_key":      true,
+}
+
+// redactedFields are JSON body fields whose values -debug-capture never logs, on
+// top of redactedParams
+var redactedFields = map[string]bool{
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+	"refresh_token": true,
+}
+
+// logHeaders adds the request headers to the request log line, set by -log-headers
+var logHeaders bool
+
+// addRedactions adds the comma separated names in list to set. Header names are
+// canonicalized so matching is case insensitive.
+func addRedactions(set map[string]bool, list string, header bool) {
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if header {
+			name = http.CanonicalHeaderKey(name)
+		}
+		set[name] = true
+	}
+}
+
+// redactHeaders copies h for logging, with sensitive values replaced
+func redactHeaders(h http.Header) map[string]string {
+	out := make(map[string]string, len(h))
+	for k, v := range h {
+		if redactedHeaders[http.CanonicalHeaderKey(k)] {
+			out[k] = redacted
+			continue
+		}
+		out[k] = strings.Join(v, ", ")
+	}
+	return out
+}
+
+// redactBody renders a captured body for logging. JSON and form bodies have
+// sensitive fields replaced; a JSON body cut short by the capture limit can't be
+// parsed, so it's dropped rather than risk logging what it holds.
+func redactBody(contentType string, body []byte, truncated bool) string {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "application/json":
+		var v interface{}
+		if truncated || json.Unmarshal(body, &v) != nil {
+			return redacted
+		}
+		b, err := json.Marshal(redactJSON(v))
+		if err != nil {
+			return redacted
+		}
+		return string(b)
+	case "application/x-www-form-urlencoded":
+		return redactQuery(string(body))
+	}
+	return string(body)
+}
+
+func redactJSON(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, e := range v {
+			if redactedFields[k] || redactedParams[k] {
+				v[k] = redacted
+				continue
+			}
+			v[k] = redactJSON(e)
+		}
+	case []interface{}:
+		for i, e := range v {
+			v[i] = redactJSON(e)
+		}
+	}
+	return v
+}
+
+// redactURL renders u for logging with sensitive query values replaced. The rest
+// of the query is left as sent, in its original order.
+func redactURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.String()
+	}
+
+	c := *u
+	c.RawQuery = redactQuery(u.RawQuery)
+	return c.String()
+}
+
+// redactQuery replaces the values of redactedParams in an encoded query string
+func redactQuery(q string) string {
+	parts := strings.Split(q, "&")
+	for i, part := range parts {
+		key, _, _ := strings.Cut(part, "=")
+		if name, err := url.QueryUnescape(key); err == nil && redactedParams[name] {
+			parts[i] = key + "=" + redacted
+		}
+	}
+	return strings.Join(parts, "&")
+}
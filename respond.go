@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// responder writes v as the response body with the given status code
+type responder func(w http.ResponseWriter, r *http.Request, code int, v interface{})
+
+// writeJSON encodes v as the response body with the given status code. The status
+// and body size are recorded in the request's log data. If v can't be encoded, the
+// error is logged and the client gets a 500 instead.
+func writeJSON(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		logError(r, err, "unable to encode json response")
+		code = http.StatusInternalServerError
+		buf.Reset()
+		buf.WriteString(`{"error":"internal server error"}` + "\n")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	n, err := w.Write(buf.Bytes())
+	if err != nil {
+		logWriteError(r, err)
+	}
+
+	logDataAdd(r, "code", code)
+	logDataAdd(r, "response_bytes", n)
+}
+
+// logWriteError records a failed response write. Clients hanging up are common and
+// expected, so they get a quiet client_disconnect event instead of an error.
+func logWriteError(r *http.Request, err error) {
+	if clientGone(r, err) {
+		logEvent(r, "client_disconnect", err.Error())
+		return
+	}
+	logError(r, err, "unable to write response")
+}
+
+// writeText writes v as plain text, formatted with fmt
+func writeText(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(code)
+	n, err := fmt.Fprintln(w, v)
+	if err != nil {
+		logWriteError(r, err)
+	}
+
+	logDataAdd(r, "code", code)
+	logDataAdd(r, "response_bytes", n)
+}
+
+// negotiate picks writeJSON or writeText from the Accept header. JSON wins ties and
+// is the default for */*, a missing header, or types we can't produce.
+func negotiate(r *http.Request) responder {
+	var qJSON, qText float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaRange, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := qValue(params)
+		switch strings.ToLower(strings.TrimSpace(mediaRange)) {
+		case "application/json", "application/*":
+			qJSON = max(qJSON, q)
+		case "text/plain", "text/*":
+			qText = max(qText, q)
+		case "*/*":
+			qJSON = max(qJSON, q)
+			qText = max(qText, q)
+		}
+	}
+	if qText > qJSON {
+		return writeText
+	}
+	return writeJSON
+}
+
+// prefersHTML reports whether the client ranks text/html above JSON, as browsers
+// do. A bare */* isn't enough, so API clients that send it keep getting JSON.
+func prefersHTML(r *http.Request) bool {
+	var qJSON, qHTML float64
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaRange, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := qValue(params)
+		switch strings.ToLower(strings.TrimSpace(mediaRange)) {
+		case "text/html", "application/xhtml+xml":
+			qHTML = max(qHTML, q)
+		case "application/json", "application/*", "*/*":
+			qJSON = max(qJSON, q)
+		}
+	}
+	return qHTML > qJSON
+}
+
+// respond writes v in whichever format the client prefers
+func respond(w http.ResponseWriter, r *http.Request, code int, v interface{}) {
+	negotiate(r)(w, r, code, v)
+}
+
+// maxBodyBytes bounds the bodies decodeJSON reads, set from -max-body-bytes.
+// Zero means no limit.
+var maxBodyBytes int64
+
+// decodeJSON decodes the JSON request body into dst. The body must be sent as
+// application/json, fit in maxBodyBytes, hold a single value, and have no fields
+// dst doesn't know about. On failure the client has already been sent a 400, 413,
+// or 415 with a JSON error and the returned error says what was wrong.
+func decodeJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	code, err := decodeJSONBody(w, r, dst)
+	if err != nil {
+		logError(r, err, "unable to decode json request")
+		writeJSON(w, r, code, map[string]string{"error": err.Error()})
+	}
+	return err
+}
+
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) (int, error) {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		return http.StatusUnsupportedMediaType, errors.New("Content-Type must be application/json")
+	}
+
+	body := r.Body
+	if maxBodyBytes > 0 {
+		body = http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	}
+	return decodeJSONValue(body, dst)
+}
+
+// decodeJSONValue is the part of decodeJSONBody that doesn't depend on the request
+func decodeJSONValue(body io.Reader, dst interface{}) (int, error) {
+	dec := json.NewDecoder(body)
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(dst)
+	if err == nil {
+		if dec.Decode(&struct{}{}) != io.EOF {
+			return http.StatusBadRequest, errors.New("body must hold a single JSON value")
+		}
+		return 0, nil
+	}
+
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, fmt.Errorf("body must not be larger than %d bytes", tooLarge.Limit)
+	case errors.As(err, &syntaxErr):
+		return http.StatusBadRequest, fmt.Errorf("malformed JSON at offset %d", syntaxErr.Offset)
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return http.StatusBadRequest, errors.New("malformed JSON")
+	case errors.As(err, &typeErr):
+		return http.StatusBadRequest, fmt.Errorf("invalid value for field %q at offset %d", typeErr.Field, typeErr.Offset)
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return http.StatusBadRequest, fmt.Errorf("unknown field %s", strings.TrimPrefix(err.Error(), "json: unknown field "))
+	case errors.Is(err, io.EOF):
+		return http.StatusBadRequest, errors.New("body must not be empty")
+	default:
+		return http.StatusBadRequest, err
+	}
+}
+
+// APIError is an error with the status and message the client should see. Err,
+// which may be nil, is the underlying cause and only ever goes to the logs.
+type APIError struct {
+	Code    int
+	Message string
+	Err     error
+}
+
+func (e *APIError) Error() string {
+	if e.Err == nil {
+		return e.Message
+	}
+	return e.Message + ": " + e.Err.Error()
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Err
+}
+
+// writeError logs err and sends it as a JSON error. An *APIError anywhere in the
+// chain sets the status and message; anything else is a 500 whose details stay
+// in the logs.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	code, message := http.StatusInternalServerError, "internal server error"
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		code, message = apiErr.Code, apiErr.Message
+	}
+	logError(r, err, message)
+	writeJSON(w, r, code, map[string]string{"error": message})
+}
+
+// handle adapts a handler that returns its errors instead of writing them: a
+// non-nil error is sent with writeError. Return errors before writing anything,
+// since the response can't be replaced once it's started. Panics aren't caught
+// here and still reach mwPanic.
+func handle(fn func(w http.ResponseWriter, r *http.Request) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := fn(w, r); err != nil {
+			writeError(w, r, err)
+		}
+	}
+}
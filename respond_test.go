@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRespondNegotiates(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", "application/json"},
+		{"*/*", "application/json"},
+		{"application/json", "application/json"},
+		{"text/plain", "text/plain; charset=utf-8"},
+		{"text/*", "text/plain; charset=utf-8"},
+		{"application/xml", "application/json"},
+		{"image/png, text/plain;q=0.5", "text/plain; charset=utf-8"},
+		{"application/json;q=0.4, text/plain;q=0.9", "text/plain; charset=utf-8"},
+		{"text/plain, application/json", "application/json"},
+		{"TEXT/PLAIN", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		rec := httptest.NewRecorder()
+		respond(rec, req, http.StatusOK, map[string]string{"a": "b"})
+		if got := rec.Header().Get("Content-Type"); got != tt.want {
+			t.Errorf("Accept %q: Content-Type = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestWriteJSONAndText(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeJSON(rec, httptest.NewRequest("GET", "/", nil), http.StatusCreated, map[string]int{"n": 1})
+	if rec.Code != http.StatusCreated || rec.Body.String() != "{\"n\":1}\n" {
+		t.Errorf("writeJSON sent %d %q", rec.Code, rec.Body.String())
+	}
+
+	rec = httptest.NewRecorder()
+	writeText(rec, httptest.NewRequest("GET", "/", nil), http.StatusTeapot, "short and stout")
+	if rec.Code != http.StatusTeapot || rec.Body.String() != "short and stout\n" {
+		t.Errorf("writeText sent %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestWriteJSONUnencodable(t *testing.T) {
+	captureLogs(t)
+	rec := httptest.NewRecorder()
+	writeJSON(rec, httptest.NewRequest("GET", "/", nil), http.StatusOK, map[string]interface{}{"ch": make(chan int)})
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("unencodable value got %d, want 500", rec.Code)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	type thing struct {
+		Name string `json:"name"`
+		N    int    `json:"n"`
+	}
+	saved := maxBodyBytes
+	maxBodyBytes = 64
+	t.Cleanup(func() { maxBodyBytes = saved })
+
+	tests := []struct {
+		name, contentType, body string
+		code                    int
+	}{
+		{"valid", "application/json", `{"name":"a","n":1}`, 0},
+		{"charset", "application/json; charset=utf-8", `{"name":"a"}`, 0},
+		{"malformed", "application/json", `{"name":`, http.StatusBadRequest},
+		{"syntax error", "application/json", `{"name" "a"}`, http.StatusBadRequest},
+		{"wrong type", "application/json", `{"n":"one"}`, http.StatusBadRequest},
+		{"unknown field", "application/json", `{"extra":true}`, http.StatusBadRequest},
+		{"two values", "application/json", `{} {}`, http.StatusBadRequest},
+		{"empty", "application/json", ``, http.StatusBadRequest},
+		{"oversized", "application/json", `{"name":"` + strings.Repeat("a", 100) + `"}`, http.StatusRequestEntityTooLarge},
+		{"wrong content type", "text/plain", `{"name":"a"}`, http.StatusUnsupportedMediaType},
+		{"no content type", "", `{"name":"a"}`, http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			var dst thing
+			err := decodeJSON(rec, req, &dst)
+
+			if tt.code == 0 {
+				if err != nil || dst.Name != "a" {
+					t.Errorf("got %v, decoded %+v", err, dst)
+				}
+				return
+			}
+			if err == nil || rec.Code != tt.code {
+				t.Fatalf("got %v and %d, want an error and %d", err, rec.Code, tt.code)
+			}
+			var body map[string]string
+			if json.Unmarshal(rec.Body.Bytes(), &body) != nil || body["error"] != err.Error() {
+				t.Errorf("body %q doesn't carry the error %q", rec.Body.String(), err)
+			}
+			logs.event(t, "error")
+		})
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		name    string
+		err     error
+		code    int
+		message string
+	}{
+		{"api error", &APIError{Code: http.StatusNotFound, Message: "no such user"}, http.StatusNotFound, "no such user"},
+		{"wrapped api error", fmt.Errorf("loading: %w", &APIError{Code: http.StatusConflict, Message: "taken", Err: errors.New("duplicate key")}), http.StatusConflict, "taken"},
+		{"unknown error", errors.New("connection refused to 10.0.0.3:5432"), http.StatusInternalServerError, "internal server error"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+			rec := httptest.NewRecorder()
+			writeError(rec, httptest.NewRequest("GET", "/", nil), tt.err)
+
+			var body map[string]string
+			if json.Unmarshal(rec.Body.Bytes(), &body); rec.Code != tt.code || body["error"] != tt.message {
+				t.Errorf("got %d %q, want %d %q", rec.Code, rec.Body.String(), tt.code, tt.message)
+			}
+			if got := logs.event(t, "error")["error"]; got != tt.err.Error() {
+				t.Errorf("logged error %v, want the full cause %q", got, tt.err)
+			}
+		})
+	}
+}
+
+func TestAPIErrorUnwrap(t *testing.T) {
+	cause := errors.New("duplicate key")
+	err := &APIError{Code: http.StatusConflict, Message: "taken", Err: cause}
+	if !errors.Is(err, cause) || err.Error() != "taken: duplicate key" {
+		t.Errorf("Error() = %q, Is(cause) = %v", err.Error(), errors.Is(err, cause))
+	}
+	if (&APIError{Message: "taken"}).Error() != "taken" {
+		t.Error("an APIError without a cause should read as its message")
+	}
+}
+
+func TestHandle(t *testing.T) {
+	captureLogs(t)
+	ok := handle(func(w http.ResponseWriter, r *http.Request) error {
+		writeJSON(w, r, http.StatusCreated, map[string]bool{"ok": true})
+		return nil
+	})
+	if rec := serve(ok, httptest.NewRequest("POST", "/", nil)); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"ok":true`) {
+		t.Errorf("nil error: got %d %q, want the handler's own response", rec.Code, rec.Body.String())
+	}
+
+	failing := handle(func(w http.ResponseWriter, r *http.Request) error {
+		return &APIError{Code: http.StatusUnprocessableEntity, Message: "bad widget"}
+	})
+	if rec := serve(failing, httptest.NewRequest("POST", "/", nil)); rec.Code != http.StatusUnprocessableEntity || !strings.Contains(rec.Body.String(), "bad widget") {
+		t.Errorf("error: got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestHandlePanicReachesMwPanic(t *testing.T) {
+	logs := captureLogs(t)
+	h := mwPanic(handle(func(w http.ResponseWriter, r *http.Request) error {
+		panic("boom")
+	}))
+	if rec := serve(h, httptest.NewRequest("GET", "/", nil)); rec.Code != http.StatusInternalServerError {
+		t.Errorf("got %d, want mwPanic's 500", rec.Code)
+	}
+	logs.event(t, "panic")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// privatePrefix is the group of routes that all require basic auth, see newRouter
+const privatePrefix = "/private"
+
+// newRouter registers the app's routes on a new router. Routes under a group's
+// prefix are behind the group's middleware whether or not their own entry asks
+// for it, so a route added to the /private group can't be public by accident.
+func newRouter(cfg Config) (*mux.Router, error) {
+	r := mux.NewRouter()
+	r.Use(mwRoute)
+	r.NotFoundHandler = http.HandlerFunc(notFoundHandler)
+	r.MethodNotAllowedHandler = methodNotAllowedHandler(r)
+
+	var cache middleware
+	if cfg.CacheTTL > 0 {
+		cache = mwCache(cfg.CacheTTL, cfg.APIKeyHeader, cfg.APIKeyParam)
+	}
+
+	routes := []route{
+		{name: "index", path: "/", handler: indexHandler, cacheable: true},
+		{name: "unauth", path: "/unauth", handler: somethingHandler, cacheable: true},
+		{name: "version", path: "/version", handler: versionHandler, cacheable: true},
+		{name: "ws", path: "/ws", handler: wsEchoHandler},
+		// streams; needs -handler-timeout and -write-timeout off, see SSEWriter
+		{name: "events", path: "/events", handler: eventsHandler},
+	}
+	if cfg.StatusPath != "" {
+		routes = append(routes, route{name: "status", path: cfg.StatusPath, handler: statusHandler})
+	}
+	switch {
+	case cfg.JWTSecret != "":
+		routes = append(routes, route{name: "jwt", path: "/jwt", handler: anotherHandler,
+			middlewares: []middleware{mwJWT([]byte(cfg.JWTSecret))}})
+	case cfg.JWTPublicKey != "":
+		key, err := loadRSAPublicKey(cfg.JWTPublicKey)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load -jwt-public-key: %v", err)
+		}
+		routes = append(routes, route{name: "jwt", path: "/jwt", handler: anotherHandler,
+			middlewares: []middleware{mwJWT(key)}})
+	}
+	registerRoutes(r, routes, cache)
+
+	// everything under /private requires auth
+	registerRoutes(subrouter(r, privatePrefix, mwAuth), []route{
+		{name: "private_auth", path: "/auth", handler: anotherHandler},
+		{name: "maintenance", path: strings.TrimPrefix(maintenancePath, privatePrefix), handler: maintenanceHandler},
+	}, cache)
+
+	// and everything under /api an API key
+	if cfg.APIKeys != "" {
+		keys, err := parseAPIKeys(cfg.APIKeys)
+		if err != nil {
+			return nil, fmt.Errorf("invalid -api-keys: %v", err)
+		}
+		registerRoutes(subrouter(r, "/api", mwAPIKey(keys, cfg.APIKeyHeader, cfg.APIKeyParam)), []route{
+			{name: "api_auth", path: "/auth", handler: anotherHandler},
+		}, cache)
+	}
+
+	if cfg.StaticDir != "" {
+		if err := mountStatic(r, cfg.StaticPrefix, cfg.StaticDir); err != nil {
+			return nil, fmt.Errorf("invalid -static-dir: %v", err)
+		}
+	}
+	return r, nil
+}
+
+// subrouter returns a router for the routes under prefix, each wrapped in mws
+// (outermost first) after matching. Server wide middleware like mwPanic and mwLog
+// belong in the chain around the top level router instead.
+func subrouter(r *mux.Router, prefix string, mws ...middleware) *mux.Router {
+	s := r.PathPrefix(prefix).Subrouter()
+	for _, mw := range mws {
+		s.Use(mux.MiddlewareFunc(mw))
+	}
+	return s
+}
+
+// route is an entry in the tables newRouter hands to registerRoutes. Server wide
+// middleware like mwPanic and mwLog belong in the chain around the router instead
+// of in middlewares.
+type route struct {
+	name    string // logged as the handler field, see mwRoute
+	path    string
+	method  string // empty matches any method
+	handler http.HandlerFunc
+
+	// requireAuth puts the route behind mwAuth, outside middlewares. Routes in
+	// the /private group have it regardless.
+	requireAuth bool
+	// middlewares wrap handler after the route matched, outermost first
+	middlewares []middleware
+	// cacheable marks GET responses that are the same for every client, so
+	// they can be served by the cache, inside middlewares
+	cacheable bool
+}
+
+// registerRoutes adds routes to r, which may be a subrouter, in order, so earlier
+// paths win when two match. cache, which may be nil, wraps the cacheable routes.
+func registerRoutes(r *mux.Router, routes []route, cache middleware) {
+	for _, rt := range routes {
+		h := http.Handler(rt.handler)
+		if rt.cacheable && cache != nil {
+			h = cache(h)
+		}
+		h = chain(h, rt.middlewares...)
+		if rt.requireAuth {
+			h = mwAuth(h)
+		}
+		m := r.Handle(rt.path, h).Name(rt.name)
+		if rt.method != "" {
+			m.Methods(rt.method)
+		}
+	}
+}
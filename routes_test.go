@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+// routeAuth is how each named route is expected to be protected. Adding a route
+// without adding it here fails TestRouteTableAuth, so nobody ships one unreviewed.
+var routeAuth = map[string]string{
+	"index":        "",
+	"unauth":       "",
+	"version":      "",
+	"ws":           "",
+	"events":       "",
+	"status":       "",
+	"private_auth": "basic",
+	"maintenance":  "basic",
+	"api_auth":     "api key",
+	"jwt":          "bearer",
+}
+
+func TestRouteTableAuth(t *testing.T) {
+	captureLogs(t)
+	saved := authUsers
+	authUsers = map[string]string{"bob": "pw"}
+	t.Cleanup(func() { authUsers = saved })
+
+	cfg := defaultConfig()
+	cfg.APIKeys = "svc:k1"
+	cfg.JWTSecret = testJWTSecret
+	r, err := newRouter(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := map[string]func(*http.Request){
+		"basic":   func(req *http.Request) { req.SetBasicAuth("bob", "pw") },
+		"api key": func(req *http.Request) { req.Header.Set(cfg.APIKeyHeader, "k1") },
+		"bearer":  func(req *http.Request) { req.Header.Set("Authorization", "Bearer "+testToken) },
+	}
+
+	// a request that ends right away, so streaming routes return
+	send := func(path string, set func(*http.Request)) int {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequest("GET", path, nil).WithContext(ctx)
+		if set != nil {
+			set(req)
+		}
+		return serve(r, req).Code
+	}
+
+	seen := 0
+	err = r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		name := route.GetName()
+		if name == "" {
+			// the prefix a subrouter hangs off
+			return nil
+		}
+		path, err := route.GetPathTemplate()
+		if err != nil {
+			return err
+		}
+		auth, ok := routeAuth[name]
+		if !ok {
+			t.Errorf("route %q (%s) isn't in routeAuth", name, path)
+			return nil
+		}
+		seen++
+
+		anonymous := send(path, nil)
+		if strings.HasPrefix(path, privatePrefix+"/") && auth != "basic" {
+			t.Errorf("%s is under %s but expected to be %q", path, privatePrefix, auth)
+		}
+		if auth == "" {
+			if anonymous == http.StatusUnauthorized {
+				t.Errorf("%s: anonymous request got 401, want a public route", path)
+			}
+			return nil
+		}
+		if anonymous != http.StatusUnauthorized {
+			t.Errorf("%s: anonymous request got %d, want 401", path, anonymous)
+		}
+		if code := send(path, credentials[auth]); code == http.StatusUnauthorized {
+			t.Errorf("%s: %s credentials were rejected", path, auth)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seen != len(routeAuth) {
+		t.Errorf("walked %d routes, routeAuth lists %d", seen, len(routeAuth))
+	}
+}
+
+func TestPrivateGroupCoversNewRoutes(t *testing.T) {
+	captureLogs(t)
+	r := mux.NewRouter()
+	registerRoutes(subrouter(r, privatePrefix, mwAuth), []route{
+		{name: "forgot_the_flag", path: "/new", handler: anotherHandler},
+	}, nil)
+
+	if rec := serve(r, httptest.NewRequest("GET", privatePrefix+"/new", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("got %d, want the group's auth to apply without requireAuth", rec.Code)
+	}
+}
+
+func TestRegisterRoutesMethod(t *testing.T) {
+	r := mux.NewRouter()
+	registerRoutes(r, []route{{name: "only_post", path: "/p", method: http.MethodPost, handler: anotherHandler}}, nil)
+
+	if rec := serve(r, httptest.NewRequest("GET", "/p", nil)); rec.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET got %d, want 405", rec.Code)
+	}
+	if rec := serve(r, httptest.NewRequest("POST", "/p", nil)); rec.Code != http.StatusOK {
+		t.Errorf("POST got %d, want 200", rec.Code)
+	}
+}
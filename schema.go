@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// fieldError is one reason a body failed its schema. Field is a JSON pointer to
+// the offending value, "" for the body as a whole.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// decodeJSONSchema is decodeJSON for bodies that must also match schema, e.g. one
+// from jsonschema.MustCompileString at startup. A body that doesn't is answered
+// with a 422 listing every problem found:
+//
+//	{"error": "body failed validation", "fields": [{"field": "/name", "message": "..."}]}
+//
+// The other failures get the same responses as from decodeJSON.
+func decodeJSONSchema(w http.ResponseWriter, r *http.Request, schema *jsonschema.Schema, dst interface{}) error {
+	var raw json.RawMessage
+	if err := decodeJSON(w, r, &raw); err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	var v interface{}
+	if err := dec.Decode(&v); err != nil {
+		// decodeJSON already parsed it, so this can't happen
+		writeError(w, r, err)
+		return err
+	}
+	if fields := validateJSON(schema, v); len(fields) > 0 {
+		err := errors.New("body failed validation")
+		logDataAdd(r, "validation_errors", len(fields))
+		logEvent(r, "validation_failed", err.Error())
+		writeJSON(w, r, http.StatusUnprocessableEntity, map[string]interface{}{"error": err.Error(), "fields": fields})
+		return err
+	}
+
+	if code, err := decodeJSONValue(bytes.NewReader(raw), dst); err != nil {
+		logError(r, err, "unable to decode json request")
+		writeJSON(w, r, code, map[string]string{"error": err.Error()})
+		return err
+	}
+	return nil
+}
+
+// validateJSON checks v, as decoded with UseNumber, against schema. The schema's
+// nested errors are flattened to the ones at the leaves, which are what actually
+// went wrong, sorted by field.
+func validateJSON(schema *jsonschema.Schema, v interface{}) []fieldError {
+	err := schema.Validate(v)
+	if err == nil {
+		return nil
+	}
+	var ve *jsonschema.ValidationError
+	if !errors.As(err, &ve) {
+		return []fieldError{{Message: err.Error()}}
+	}
+
+	var fields []fieldError
+	var walk func(*jsonschema.ValidationError)
+	walk = func(e *jsonschema.ValidationError) {
+		if len(e.Causes) == 0 {
+			fields = append(fields, fieldError{Field: e.InstanceLocation, Message: e.Message})
+			return
+		}
+		for _, c := range e.Causes {
+			walk(c)
+		}
+	}
+	walk(ve)
+	sort.SliceStable(fields, func(i, j int) bool { return fields[i].Field < fields[j].Field })
+	return fields
+}
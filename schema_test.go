@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+var testSchema = jsonschema.MustCompileString("thing.json", `{
+	"type": "object",
+	"required": ["name", "count"],
+	"properties": {
+		"name":  {"type": "string", "minLength": 1},
+		"count": {"type": "integer", "minimum": 0},
+		"email": {"type": "string", "format": "email"}
+	}
+}`)
+
+type schemaThing struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+	Email string `json:"email"`
+}
+
+func schemaPost(body string) *http.Request {
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	return req
+}
+
+func TestDecodeJSONSchemaValid(t *testing.T) {
+	captureLogs(t)
+	var got schemaThing
+	rec := httptest.NewRecorder()
+	if err := decodeJSONSchema(rec, schemaPost(`{"name":"a","count":2,"email":"a@example.com"}`), testSchema, &got); err != nil {
+		t.Fatalf("valid body rejected: %v: %s", err, rec.Body.String())
+	}
+	if got != (schemaThing{Name: "a", Count: 2, Email: "a@example.com"}) {
+		t.Errorf("decoded %+v", got)
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("a response was written: %q", rec.Body.String())
+	}
+}
+
+func TestDecodeJSONSchemaInvalid(t *testing.T) {
+	logs := captureLogs(t)
+	var got schemaThing
+	rec := httptest.NewRecorder()
+	req := schemaPost(`{"name":"","count":-1,"email":"nope"}`)
+	if err := decodeJSONSchema(rec, req, testSchema, &got); err == nil {
+		t.Fatal("invalid body accepted")
+	}
+	if rec.Code != http.StatusUnprocessableEntity || rec.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("got %d, Content-Type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	var body struct {
+		Error  string       `json:"error"`
+		Fields []fieldError `json:"fields"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatal(err)
+	}
+	if body.Error != "body failed validation" {
+		t.Errorf("error = %q", body.Error)
+	}
+	var fields []string
+	for _, f := range body.Fields {
+		if f.Message == "" {
+			t.Errorf("%s has no message", f.Field)
+		}
+		fields = append(fields, f.Field)
+	}
+	if strings.Join(fields, " ") != "/count /email /name" {
+		t.Errorf("fields = %q, want every problem, sorted", fields)
+	}
+	if logs.event(t, "validation_failed") == nil {
+		t.Error("the failure wasn't logged")
+	}
+}
+
+func TestDecodeJSONSchemaMissingFields(t *testing.T) {
+	captureLogs(t)
+	rec := httptest.NewRecorder()
+	decodeJSONSchema(rec, schemaPost(`{}`), testSchema, &schemaThing{})
+	var body struct {
+		Fields []fieldError `json:"fields"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if rec.Code != http.StatusUnprocessableEntity || len(body.Fields) == 0 {
+		t.Errorf("got %d %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestDecodeJSONSchemaKeepsDecodeErrors(t *testing.T) {
+	tests := map[string]struct {
+		contentType, body string
+		code              int
+	}{
+		"malformed":     {"application/json", `{"name":`, http.StatusBadRequest},
+		"content type":  {"text/plain", `{"name":"a","count":1}`, http.StatusUnsupportedMediaType},
+		"unknown field": {"application/json", `{"name":"a","count":1,"extra":true}`, http.StatusBadRequest},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			captureLogs(t)
+			req := schemaPost(tt.body)
+			req.Header.Set("Content-Type", tt.contentType)
+			rec := httptest.NewRecorder()
+			if err := decodeJSONSchema(rec, req, testSchema, &schemaThing{}); err == nil || rec.Code != tt.code {
+				t.Errorf("got %d, %v; want %d", rec.Code, err, tt.code)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMwSecurityHeaders(t *testing.T) {
+	h := mwSecurityHeaders(defaultSecurityHeaders)(http.HandlerFunc(anotherHandler))
+
+	rec := serve(h, httptest.NewRequest("GET", "/", nil))
+	want := map[string]string{
+		"X-Content-Type-Options": "nosniff",
+		"X-Frame-Options":        "DENY",
+		"Referrer-Policy":        "strict-origin-when-cross-origin",
+	}
+	for name, value := range want {
+		if got := rec.Header().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("HSTS sent over plain HTTP: %q", got)
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.TLS = &tls.ConnectionState{}
+	if rec := serve(h, req); rec.Header().Get("Strict-Transport-Security") != defaultSecurityHeaders.hsts {
+		t.Errorf("HSTS over TLS = %q", rec.Header().Get("Strict-Transport-Security"))
+	}
+}
+
+func TestMwSecurityHeadersDisabled(t *testing.T) {
+	sh := defaultSecurityHeaders
+	sh.frameOptions = ""
+	rec := serve(mwSecurityHeaders(sh)(http.HandlerFunc(anotherHandler)), httptest.NewRequest("GET", "/", nil))
+	if _, ok := rec.Header()["X-Frame-Options"]; ok {
+		t.Error("an empty value still sent X-Frame-Options")
+	}
+	if rec.Header().Get("X-Content-Type-Options") != "nosniff" {
+		t.Error("disabling one header dropped the others")
+	}
+}
+
+func TestMwAllowedHosts(t *testing.T) {
+	h := mwAllowedHosts("api.example.com", "*.apps.example.com", " Admin.Example.com ")(http.HandlerFunc(anotherHandler))
+	tests := []struct {
+		host string
+		code int
+	}{
+		{"api.example.com", http.StatusOK},
+		{"API.EXAMPLE.COM:8443", http.StatusOK},
+		{"api.example.com.", http.StatusOK},
+		{"admin.example.com", http.StatusOK},
+		{"one.apps.example.com", http.StatusOK},
+		{"a.b.apps.example.com", http.StatusOK},
+		{"apps.example.com", http.StatusBadRequest},
+		{"evilapps.example.com", http.StatusBadRequest},
+		{"evil.example", http.StatusBadRequest},
+		{"api.example.com.evil.example", http.StatusBadRequest},
+		{"", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			logs := captureLogs(t)
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Host = tt.host
+			if rec := serve(h, req); rec.Code != tt.code {
+				t.Errorf("got %d, want %d", rec.Code, tt.code)
+			}
+			if tt.code == http.StatusBadRequest {
+				logs.event(t, "host_rejected")
+			}
+		})
+	}
+}
+
+func TestMwAllowedHostsSkipsProbes(t *testing.T) {
+	captureLogs(t)
+	h := mwHealth("/healthz", "/readyz")(mwAllowedHosts("api.example.com")(http.HandlerFunc(anotherHandler)))
+	req := httptest.NewRequest("GET", "/healthz", nil)
+	req.Host = "10.0.0.7:8080"
+	if rec := serve(h, req); rec.Code != http.StatusOK {
+		t.Errorf("a probe sent to an IP got %d, want 200", rec.Code)
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// SSEWriter streams server-sent events, flushing each one as it's sent.
+//
+// Streams outlive the usual deadlines: http.TimeoutHandler, and so mwTimeout,
+// can't flush at all, and -write-timeout cuts the connection once it passes.
+// Serve SSE routes with -handler-timeout and -write-timeout set to 0.
+type SSEWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+	r *http.Request
+}
+
+// newSSEWriter sends the event stream headers. It fails if w can't flush, which
+// usually means a wrapper in the middleware chain doesn't pass Flush through.
+func newSSEWriter(w http.ResponseWriter, r *http.Request) (*SSEWriter, error) {
+	f, ok := w.(http.Flusher)
+	if !ok {
+		return nil, errors.New("response writer does not support flushing")
+	}
+	hdr := w.Header()
+	hdr.Set("Content-Type", "text/event-stream")
+	hdr.Set("Cache-Control", "no-cache")
+	// stops nginx and similar proxies from buffering the stream
+	hdr.Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+	return &SSEWriter{w: w, f: f, r: r}, nil
+}
+
+// Send writes one event and flushes it. event may be empty for the default
+// "message" type, and is rejected if it has a line break, which would end the
+// field early and let the rest pass as fields of its own. Multi-line data is
+// split into several data lines at any of the CRLF, CR, and LF line endings
+// clients recognize. Once the client has gone, Send returns the request
+// context's error.
+func (s *SSEWriter) Send(event, data string) error {
+	if err := s.r.Context().Err(); err != nil {
+		return err
+	}
+	if strings.ContainsAny(event, "\r\n") {
+		return fmt.Errorf("event name %q contains a line break", event)
+	}
+	var b strings.Builder
+	if event != "" {
+		fmt.Fprintf(&b, "event: %s\n", event)
+	}
+	for _, line := range strings.Split(lineEndings.Replace(data), "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+	b.WriteString("\n")
+	if _, err := s.w.Write([]byte(b.String())); err != nil {
+		return err
+	}
+	s.f.Flush()
+	return nil
+}
+
+// lineEndings normalizes CRLF and CR to LF
+var lineEndings = strings.NewReplacer("\r\n", "\n", "\r", "\n")
+
+// eventsHandler demonstrates SSEWriter with a tick every second until the client
+// disconnects
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	sse, err := newSSEWriter(w, r)
+	if err != nil {
+		logError(r, err, "unable to start event stream")
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"error": "streaming unsupported"})
+		return
+	}
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case now := <-t.C:
+			if err := sse.Send("tick", now.UTC().Format(time.RFC3339)); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSSEWriterFlushesEachEvent(t *testing.T) {
+	captureLogs(t)
+	next := make(chan struct{})
+	srv := httptest.NewServer(mwLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sse, err := newSSEWriter(w, r)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		sse.Send("greeting", "hello")
+		<-next
+		sse.Send("", "two\nlines")
+	})))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" || resp.Header.Get("X-Accel-Buffering") != "no" {
+		t.Errorf("headers %v", resp.Header)
+	}
+	lines := bufio.NewReader(resp.Body)
+	frame := func() string {
+		var b strings.Builder
+		for {
+			line, err := lines.ReadString('\n')
+			if err != nil {
+				t.Fatalf("stream ended early: %v", err)
+			}
+			if line == "\n" {
+				return b.String()
+			}
+			b.WriteString(line)
+		}
+	}
+
+	// the second event isn't written until this one arrives, so it must have
+	// been flushed on its own
+	if got := frame(); got != "event: greeting\ndata: hello\n" {
+		t.Errorf("first frame = %q", got)
+	}
+	close(next)
+	if got := frame(); got != "data: two\ndata: lines\n" {
+		t.Errorf("second frame = %q", got)
+	}
+}
+
+func TestSSEWriterStopsWhenClientGoes(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req := httptest.NewRequest("GET", "/", nil).WithContext(ctx)
+	sse, err := newSSEWriter(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if err := sse.Send("", "x"); err != context.Canceled {
+		t.Errorf("Send after the client left returned %v", err)
+	}
+}
+
+func TestNewSSEWriterNeedsFlusher(t *testing.T) {
+	if _, err := newSSEWriter(writeOnly{httptest.NewRecorder()}, httptest.NewRequest("GET", "/", nil)); err == nil {
+		t.Error("a writer that can't flush was accepted")
+	}
+}
+
+func TestSSEWriterLineBreaks(t *testing.T) {
+	rec := httptest.NewRecorder()
+	sse, err := newSSEWriter(rec, httptest.NewRequest("GET", "/", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, event := range []string{"tick\ndata: forged", "tick\rid: 1"} {
+		if err := sse.Send(event, "x"); err == nil {
+			t.Errorf("event name %q was accepted", event)
+		}
+	}
+	if rec.Body.Len() != 0 {
+		t.Fatalf("rejected events were written: %q", rec.Body.String())
+	}
+
+	sse.Send("", "one\rtwo\r\nthree\nfour")
+	if want := "data: one\ndata: two\ndata: three\ndata: four\n\n"; rec.Body.String() != want {
+		t.Errorf("body = %q, want %q", rec.Body.String(), want)
+	}
+}
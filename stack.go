@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// panicMaxFrames caps how many frames of a panic's stack are logged
+var panicMaxFrames = 32
+
+// stackFrame is one call in a parsed goroutine stack
+type stackFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
+
+// parseStack turns debug.Stack output into frames, starting at the frame that
+// panicked so the recovery machinery above it is left out, and keeping at most
+// max frames
+func parseStack(stack []byte, max int) []stackFrame {
+	lines := strings.Split(string(bytes.TrimSpace(stack)), "\n")
+	var frames []stackFrame
+	// the first line is the goroutine header, then each frame is a function line
+	// followed by a tab indented file:line +offset line
+	for i := 1; i+1 < len(lines); i += 2 {
+		fn := lines[i]
+		if paren := strings.LastIndex(fn, "("); paren > 0 {
+			fn = fn[:paren]
+		}
+		loc := strings.TrimSpace(lines[i+1])
+		if sp := strings.IndexByte(loc, ' '); sp >= 0 {
+			loc = loc[:sp]
+		}
+		file, line := loc, 0
+		if colon := strings.LastIndexByte(loc, ':'); colon >= 0 {
+			file = loc[:colon]
+			line, _ = strconv.Atoi(loc[colon+1:])
+		}
+
+		if fn == "panic" {
+			frames = frames[:0]
+			continue
+		}
+		frames = append(frames, stackFrame{Function: fn, File: file, Line: line})
+	}
+	if len(frames) > max {
+		frames = frames[:max]
+	}
+	return frames
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPanicEventHasStructuredStack(t *testing.T) {
+	logs := captureLogs(t)
+	serve(mwPanic(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m map[string]int
+		m["boom"] = 1
+	})), httptest.NewRequest("GET", "/", nil))
+
+	line := logs.event(t, "panic")
+	if v, _ := line["panic_value"].(string); !strings.Contains(v, "nil map") {
+		t.Errorf("panic_value = %q", v)
+	}
+	frames, ok := line["stack"].([]stackFrame)
+	if !ok || len(frames) == 0 {
+		t.Fatalf("stack = %#v, want parsed frames", line["stack"])
+	}
+	top := frames[0]
+	if !strings.Contains(top.Function, "TestPanicEventHasStructuredStack") || !strings.HasSuffix(top.File, "stack_test.go") || top.Line == 0 {
+		t.Errorf("top frame = %+v, want the line that panicked", top)
+	}
+	if strings.Contains(line["message"].(string), "goroutine") {
+		t.Error("the message still holds the raw stack")
+	}
+}
+
+func TestParseStack(t *testing.T) {
+	stack := []byte(`goroutine 7 [running]:
+runtime/debug.Stack()
+	/usr/local/go/src/runtime/debug/stack.go:26 +0x5e
+main.mwPanicWith.func1.1()
+	/src/main.go:640 +0x1a5
+panic({0x6d4f20?, 0x7d92a0?})
+	/usr/local/go/src/runtime/panic.go:785 +0x132
+main.handler(...)
+	/src/app.go:12
+main.serve(0xc000100000)
+	/src/app.go:30 +0x25
+`)
+	frames := parseStack(stack, 32)
+	want := []stackFrame{{"main.handler", "/src/app.go", 12}, {"main.serve", "/src/app.go", 30}}
+	if len(frames) != len(want) {
+		t.Fatalf("got %+v, want %+v", frames, want)
+	}
+	for i := range want {
+		if frames[i] != want[i] {
+			t.Errorf("frame %d = %+v, want %+v", i, frames[i], want[i])
+		}
+	}
+	if got := parseStack(stack, 1); len(got) != 1 || got[0] != want[0] {
+		t.Errorf("capped at 1 frame got %+v", got)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// mountStatic serves the files in dir under prefix on r. os.Root confines lookups
+// to dir, so neither ".." segments nor symlinks can reach files outside of it.
+func mountStatic(r *mux.Router, prefix, dir string) error {
+	root, err := os.OpenRoot(dir)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+		return fmt.Errorf("prefix %q must start and end with /", prefix)
+	}
+	r.PathPrefix(prefix).Handler(http.StripPrefix(prefix, http.FileServerFS(root.FS()))).Name("static")
+	return nil
+}
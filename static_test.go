@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestMountStatic(t *testing.T) {
+	logs := captureLogs(t)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "app.css"), []byte("body{}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	if err := mountStatic(r, "/static/", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := serve(mwLog(r), httptest.NewRequest("GET", "/static/app.css", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "body{}" {
+		t.Fatalf("got %d %q", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/css") {
+		t.Errorf("Content-Type = %q, want text/css", ct)
+	}
+	if got := logs.event(t, "request")["code"]; got != http.StatusOK {
+		t.Errorf("asset request logged %v, want 200", got)
+	}
+}
+
+func TestMountStaticStaysInRoot(t *testing.T) {
+	captureLogs(t)
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "public")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	secret := filepath.Join(parent, "secret.txt")
+	if err := os.WriteFile(secret, []byte("hunter2"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(secret, filepath.Join(dir, "link.txt")); err != nil {
+		t.Fatal(err)
+	}
+	r := mux.NewRouter()
+	if err := mountStatic(r, "/static/", dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, target := range []string{"/static/../secret.txt", "/static/%2e%2e/secret.txt", "/static/..%2fsecret.txt", "/static/link.txt"} {
+		rec := serve(r, httptest.NewRequest("GET", target, nil))
+		if rec.Code == http.StatusOK || strings.Contains(rec.Body.String(), "hunter2") {
+			t.Errorf("%s escaped the root: %d %q", target, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestMountStaticBadPrefix(t *testing.T) {
+	if err := mountStatic(mux.NewRouter(), "/static", t.TempDir()); err == nil {
+		t.Error("a prefix without a trailing slash was accepted")
+	}
+	if err := mountStatic(mux.NewRouter(), "/static/", filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("a missing directory was accepted")
+	}
+}
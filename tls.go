@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// newTLSConfig requires TLS 1.2 or later and restricts TLS 1.2 to forward-secret
+// AEAD cipher suites. TLS 1.3 suites aren't configurable and are all fine.
+func newTLSConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		CipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+		},
+		CurvePreferences: []tls.CurveID{tls.X25519, tls.CurveP256},
+	}
+}
+
+// checkTLSFlags makes sure the cert and key are given together, and that client
+// certs are only asked for when serving TLS
+func checkTLSFlags(cert, key, clientCA string) error {
+	if (cert == "") != (key == "") {
+		return errors.New("-tls-cert and -tls-key must be set together")
+	}
+	if clientCA != "" && cert == "" {
+		return errors.New("-client-ca requires -tls-cert and -tls-key")
+	}
+	return nil
+}
+
+// certReloader serves the -tls-cert and -tls-key pair through
+// tls.Config.GetCertificate and swaps in a fresh pair when asked, so rotated
+// certificates are picked up without a restart. Handshakes in progress keep the
+// certificate they started with.
+type certReloader struct {
+	certFile, keyFile string
+	cert              atomic.Pointer[tls.Certificate]
+}
+
+// newCertReloader loads the pair once, so a bad one fails at startup
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	c := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Reload reads the pair again. On failure the current certificate stays in use.
+func (c *certReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert.Store(&cert)
+	return nil
+}
+
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.cert.Load(), nil
+}
+
+// reloadOnHUP reloads c whenever the process gets SIGHUP, the same signal that
+// reopens -log-output
+func (c *certReloader) reloadOnHUP() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := c.Reload(); err != nil {
+			logError(nil, err, "unable to reload -tls-cert, keeping the current certificate")
+			continue
+		}
+		logEvent(nil, "tls_reloaded", "reloaded "+c.certFile)
+	}
+}
+
+// requireClientCerts makes c reject any connection that doesn't present a client
+// certificate signed by one of the CAs in the PEM bundle at caPath
+func requireClientCerts(c *tls.Config, caPath string) error {
+	b, err := os.ReadFile(caPath)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return fmt.Errorf("no certificates found in %s", caPath)
+	}
+	c.ClientCAs = pool
+	c.ClientAuth = tls.RequireAndVerifyClientCert
+	return nil
+}
+
+// mwClientCert puts the verified client certificate in the request context (see
+// clientCert) and its subject in the log data. Verification already happened
+// during the handshake, so this only records who connected.
+func mwClientCert(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			cert := r.TLS.PeerCertificates[0]
+			logDataAdd(r, "client_cert_subject", cert.Subject.String())
+			r = r.WithContext(context.WithValue(r.Context(), clientCertKey, cert))
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// clientCert returns the certificate stored by mwClientCert, or nil
+func clientCert(r *http.Request) *x509.Certificate {
+	cert, _ := r.Context().Value(clientCertKey).(*x509.Certificate)
+	return cert
+}
+
+// acmeChallengePrefix is where ACME HTTP-01 challenges are answered; they have to
+// stay reachable over plain HTTP
+const acmeChallengePrefix = "/.well-known/acme-challenge/"
+
+// mwHTTPSRedirect sends plain HTTP requests to the https:// URL with the same
+// path and query, with a 308 so the method and body are kept. host, with an
+// optional port, replaces the request's host when the public name differs; when
+// empty the request's host is used on the default port. ACME challenges are
+// passed on to h instead.
+func mwHTTPSRedirect(host string) middleware {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, acmeChallengePrefix) {
+				h.ServeHTTP(w, r)
+				return
+			}
+			target := httpsURL(r, host)
+			if target == "" {
+				http.Error(w, "missing Host header", http.StatusBadRequest)
+				return
+			}
+			http.Redirect(w, r, target, http.StatusPermanentRedirect)
+		})
+	}
+}
+
+// httpsURL is the https:// URL for r on host, or on r's own host without its port
+// when host is empty. It's empty when there's no host to use.
+func httpsURL(r *http.Request, host string) string {
+	if host == "" {
+		host = r.Host
+		if name, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = name
+			if strings.Contains(name, ":") {
+				host = "[" + name + "]"
+			}
+		}
+	}
+	if host == "" {
+		return ""
+	}
+	u := url.URL{Scheme: "https", Host: host, Path: r.URL.Path, RawPath: r.URL.RawPath, RawQuery: r.URL.RawQuery}
+	return u.String()
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is an in-memory certificate authority for issuing client certs
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a client certificate for cn signed by the CA
+func (ca *testCA) issue(t *testing.T, cn string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertAuth(t *testing.T) {
+	logs := captureLogs(t)
+	ca := newTestCA(t)
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caPath, ca.pem, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewUnstartedServer(mwLog(mwClientCert(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cert := clientCert(r); cert != nil {
+			io.WriteString(w, cert.Subject.CommonName)
+		}
+	}))))
+	srv.TLS = newTLSConfig()
+	if err := requireClientCerts(srv.TLS, caPath); err != nil {
+		t.Fatal(err)
+	}
+	// the rejected handshakes below would be logged to stderr
+	srv.Config.ErrorLog = log.New(io.Discard, "", 0)
+	srv.StartTLS()
+	defer srv.Close()
+
+	// a fresh transport per client, so no connection is reused across certs
+	clientWith := func(certs ...tls.Certificate) *http.Client {
+		tr := srv.Client().Transport.(*http.Transport).Clone()
+		tr.TLSClientConfig.Certificates = certs
+		return &http.Client{Transport: tr}
+	}
+	resp, err := clientWith(ca.issue(t, "billing")).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(b) != "billing" {
+		t.Errorf("handler saw client cert %q, want billing", b)
+	}
+	if got := logs.event(t, "request")["client_cert_subject"]; got != "CN=billing" {
+		t.Errorf("client_cert_subject = %v", got)
+	}
+
+	for name, certs := range map[string][]tls.Certificate{
+		"no cert":         nil,
+		"other CA's cert": {newTestCA(t).issue(t, "intruder")},
+	} {
+		if resp, err := clientWith(certs...).Get(srv.URL); err == nil {
+			resp.Body.Close()
+			t.Errorf("%s: the handshake succeeded", name)
+		}
+	}
+}
+
+func TestRequireClientCertsBadBundle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(path, []byte("not pem"), 0o600)
+	if err := requireClientCerts(newTLSConfig(), path); err == nil {
+		t.Error("a bundle without certificates was accepted")
+	}
+}
+
+// writeKeyPair writes cert as the PEM files -tls-cert and -tls-key expect
+func writeKeyPair(t *testing.T, certFile, keyFile string, cert tls.Certificate) {
+	t.Helper()
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCertReloader(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeKeyPair(t, certFile, keyFile, ca.issue(t, "old"))
+
+	c, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = newTLSConfig()
+	srv.TLS.GetCertificate = c.GetCertificate
+	srv.StartTLS()
+	defer srv.Close()
+
+	// a fresh connection each time, so every request does a handshake. The
+	// ServerName matters: without SNI, crypto/tls serves httptest's own
+	// certificate from srv.TLS.Certificates rather than asking GetCertificate.
+	served := func() string {
+		t.Helper()
+		tr := &http.Transport{TLSClientConfig: &tls.Config{ServerName: "reload.test", InsecureSkipVerify: true}}
+		resp, err := (&http.Client{Transport: tr}).Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		tr.CloseIdleConnections()
+		return resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+	if got := served(); got != "old" {
+		t.Fatalf("served %q before the reload, want old", got)
+	}
+
+	writeKeyPair(t, certFile, keyFile, ca.issue(t, "new"))
+	if got := served(); got != "old" {
+		t.Errorf("served %q before Reload was called", got)
+	}
+	if err := c.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if got := served(); got != "new" {
+		t.Errorf("served %q after the reload, want new", got)
+	}
+
+	// a broken pair on disk keeps the current certificate
+	if err := os.WriteFile(keyFile, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Reload(); err == nil {
+		t.Error("reloading a broken pair didn't fail")
+	}
+	if got := served(); got != "new" {
+		t.Errorf("served %q after a failed reload, want new", got)
+	}
+}
+
+func TestNewCertReloaderMissingFiles(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil {
+		t.Error("missing files were accepted at startup")
+	}
+}
+
+func TestMwHTTPSRedirect(t *testing.T) {
+	tests := []struct {
+		name, host, requestHost, target, want string
+	}{
+		{"request host", "", "example.com", "/a/b?x=1&y=2", "https://example.com/a/b?x=1&y=2"},
+		{"drops the plain port", "", "example.com:8080", "/", "https://example.com/"},
+		{"ipv6", "", "[::1]:8080", "/x", "https://[::1]/x"},
+		{"configured host", "public.example:8443", "internal:8080", "/x?q=%2F", "https://public.example:8443/x?q=%2F"},
+		{"encoded path", "", "example.com", "/a%2Fb", "https://example.com/a%2Fb"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.target, nil)
+			req.Host = tt.requestHost
+			rec := serve(mwHTTPSRedirect(tt.host)(http.NotFoundHandler()), req)
+			if rec.Code != http.StatusPermanentRedirect || rec.Header().Get("Location") != tt.want {
+				t.Errorf("got %d to %q, want 308 to %q", rec.Code, rec.Header().Get("Location"), tt.want)
+			}
+		})
+	}
+}
+
+func TestMwHTTPSRedirectSkips(t *testing.T) {
+	var reached bool
+	h := mwHTTPSRedirect("")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { reached = true }))
+	serve(h, httptest.NewRequest("GET", acmeChallengePrefix+"token", nil))
+	if !reached {
+		t.Error("an ACME challenge was redirected")
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Host = ""
+	if rec := serve(h, req); rec.Code != http.StatusBadRequest {
+		t.Errorf("no Host got %d, want 400", rec.Code)
+	}
+}
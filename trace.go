@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// tracerProvider creates the server spans. It's a no-op until an exporter backed
+// provider is plugged in before serving.
+var tracerProvider trace.TracerProvider = noop.NewTracerProvider()
+
+// tracePropagator reads W3C traceparent and tracestate headers
+var tracePropagator propagation.TextMapPropagator = propagation.TraceContext{}
+
+// mwTrace starts a server span per request, continuing any incoming W3C trace
+// context. The span is named by the route template once routing is done (see
+// mwRoute) and the trace and span IDs are added to the log data. It belongs inside
+// mwLog so the IDs make it into the request line.
+func mwTrace(tp trace.TracerProvider) middleware {
+	tracer := tp.Tracer("httpskeleton")
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, r.Method, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+			defer span.End()
+
+			if sc := span.SpanContext(); sc.IsValid() {
+				logDataAdd(r, "trace_id", sc.TraceID().String())
+				logDataAdd(r, "span_id", sc.SpanID().String())
+			}
+
+			lw := newLogWriter(w, r)
+			defer writers.Put(lw)
+
+			r = r.WithContext(ctx)
+			h.ServeHTTP(lw, r)
+
+			if route, ok := logDataGet(r)["route"].(string); ok {
+				span.SetName(fmt.Sprintf("%s %s", r.Method, route))
+				span.SetAttributes(attribute.String("http.route", route))
+			}
+			span.SetAttributes(attribute.Int("http.response.status_code", lw.Code()))
+			if lw.Code() >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(lw.Code()))
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"runtime/debug"
+)
+
+// version, commit, and buildTime identify the build. Set them with
+//
+//	go build -ldflags "-X main.version=1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildTime=$(date -u +%FT%TZ)"
+//
+// Anything left unset is filled in from the module and VCS info the go tool
+// embeds, see loadBuildInfo.
+var version, commit, buildTime string
+
+// loadBuildInfo fills in whatever -ldflags didn't set. Call it once at startup.
+func loadBuildInfo() {
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		if version == "" && bi.Main.Version != "" && bi.Main.Version != "(devel)" {
+			version = bi.Main.Version
+		}
+		for _, s := range bi.Settings {
+			switch {
+			case s.Key == "vcs.revision" && commit == "":
+				commit = s.Value
+			case s.Key == "vcs.time" && buildTime == "":
+				buildTime = s.Value
+			}
+		}
+	}
+	if version == "" {
+		version = "dev"
+	}
+}
+
+func buildInfo() map[string]interface{} {
+	return map[string]interface{}{
+		"version":    version,
+		"commit":     commit,
+		"build_time": buildTime,
+	}
+}
+
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, r, http.StatusOK, buildInfo())
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// wsGUID is appended to the client's key to compute Sec-WebSocket-Accept (RFC 6455)
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// wsMaxPayload caps the frames wsEchoHandler accepts. Being an example, it doesn't
+// handle fragmented or oversized messages.
+const wsMaxPayload = 64 << 10
+
+// wsEchoHandler is a minimal WebSocket echo server showing a hijacked connection
+// through the middleware chain. Once hijacked the conn is the handler's alone:
+// mwLog records the 101 but no bytes, and mwTimeout and -write-timeout no longer
+// apply. Real services should use a full implementation such as gorilla/websocket.
+func wsEchoHandler(w http.ResponseWriter, r *http.Request) {
+	if !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		writeJSON(w, r, http.StatusBadRequest, map[string]string{"error": "expected a websocket upgrade"})
+		return
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		writeJSON(w, r, http.StatusBadRequest, map[string]string{"error": "unsupported websocket handshake"})
+		return
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		logError(r, errors.New("response writer does not support hijacking"), "unable to upgrade to websocket")
+		writeJSON(w, r, http.StatusInternalServerError, map[string]string{"error": "upgrade unsupported"})
+		return
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		logError(r, err, "unable to upgrade to websocket")
+		return
+	}
+	defer conn.Close()
+
+	sum := sha1.Sum([]byte(key + wsGUID))
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n",
+		base64.StdEncoding.EncodeToString(sum[:]))
+	if err := rw.Flush(); err != nil {
+		return
+	}
+	wsEcho(conn, rw.Reader)
+}
+
+// wsEcho sends text and binary frames back until the client closes or errs
+func wsEcho(conn net.Conn, br *bufio.Reader) {
+	for {
+		opcode, payload, err := wsReadFrame(br)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case 0x1, 0x2:
+			if wsWriteFrame(conn, opcode, payload) != nil {
+				return
+			}
+		case 0x8:
+			wsWriteFrame(conn, 0x8, payload)
+			return
+		case 0x9:
+			if wsWriteFrame(conn, 0xA, payload) != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsReadFrame reads one masked client frame
+func wsReadFrame(br *bufio.Reader) (byte, []byte, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(br, hdr[:]); err != nil {
+		return 0, nil, err
+	}
+	if hdr[0]&0x80 == 0 {
+		return 0, nil, errors.New("fragmented frames aren't supported")
+	}
+	if hdr[1]&0x80 == 0 {
+		return 0, nil, errors.New("client frames must be masked")
+	}
+	n := uint64(hdr[1] & 0x7f)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(br, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > wsMaxPayload {
+		return 0, nil, fmt.Errorf("frame of %d bytes is over the limit", n)
+	}
+	var mask [4]byte
+	if _, err := io.ReadFull(br, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(br, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return hdr[0] & 0x0f, payload, nil
+}
+
+// wsWriteFrame writes one unmasked, unfragmented server frame
+func wsWriteFrame(w io.Writer, opcode byte, payload []byte) error {
+	hdr := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n < 126:
+		hdr = append(hdr, byte(n))
+	case n <= 0xffff:
+		hdr = append(hdr, 126)
+		hdr = binary.BigEndian.AppendUint16(hdr, uint16(n))
+	default:
+		hdr = append(hdr, 127)
+		hdr = binary.BigEndian.AppendUint64(hdr, uint64(n))
+	}
+	_, err := w.Write(append(hdr, payload...))
+	return err
+}
+
+// headerHasToken reports whether the comma separated header name contains token,
+// case insensitively, as with "Connection: keep-alive, Upgrade"
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// wsClientFrame is a masked, unfragmented client frame
+func wsClientFrame(opcode byte, payload []byte) []byte {
+	mask := []byte{1, 2, 3, 4}
+	frame := append([]byte{0x80 | opcode, 0x80 | byte(len(payload))}, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func TestWSEchoThroughMwLog(t *testing.T) {
+	logs := captureLogs(t)
+	srv := httptest.NewServer(mwLog(http.HandlerFunc(wsEchoHandler)))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	// the handshake from RFC 6455 section 1.3
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: x\r\nConnection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("handshake got %d, accept %q", resp.StatusCode, resp.Header.Get("Sec-WebSocket-Accept"))
+	}
+
+	conn.Write(wsClientFrame(0x1, []byte("hello")))
+	echo := make([]byte, 7)
+	if _, err := io.ReadFull(br, echo); err != nil || !bytes.Equal(echo, []byte("\x81\x05hello")) {
+		t.Fatalf("echo = %q, %v", echo, err)
+	}
+	conn.Write(wsClientFrame(0x8, nil))
+	io.Copy(io.Discard, br)
+
+	// mwLog logs once the handler has returned, just after the conn is closed
+	for deadline := time.Now().Add(time.Second); len(logs.events("request")) == 0 && time.Now().Before(deadline); {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if got := logs.event(t, "request")["code"]; got != http.StatusSwitchingProtocols {
+		t.Errorf("upgrade logged as %v, want 101", got)
+	}
+}
+
+func TestWSEchoRejectsPlainRequests(t *testing.T) {
+	rec := serve(http.HandlerFunc(wsEchoHandler), httptest.NewRequest("GET", "/ws", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("a plain GET got %d, want 400", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/ws", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "8")
+	if rec := serve(http.HandlerFunc(wsEchoHandler), req); rec.Code != http.StatusBadRequest || rec.Header().Get("Sec-WebSocket-Version") != "13" {
+		t.Errorf("version 8 got %d, Sec-WebSocket-Version %q", rec.Code, rec.Header().Get("Sec-WebSocket-Version"))
+	}
+}